@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/TykTechnologies/go-plugins-template/protocol"
+	"github.com/TykTechnologies/go-plugins-template/trail"
+)
+
+const (
+	AccessLogJSON = "json"
+	AccessLogText = "text"
+
+	// Apache combined log format, default for text format
+	combinedLogFields = "remote_addr,ident,identity,time,request,status,bytes,referer,user_agent"
+	jsonLogFields     = "time,remote_addr,identity,method,path,query,status,bytes,duration_ms,user_agent"
+)
+
+type accessLogContextKey struct{}
+
+// Everything known about a request once it is served
+type accessLogRecord struct {
+	start   time.Time
+	request *http.Request
+	// Request as it reached the end of the chain, with context values added by
+	// middlewares and plugins. Nil if request was rejected before.
+	final      *http.Request
+	header     http.Header
+	status     int
+	bytes      int64
+	ttfb       time.Duration
+	duration   time.Duration
+	subject    string
+	authMethod string
+	upstream   string
+}
+
+type accessLogField struct {
+	// Numeric values are written without quotes
+	numeric bool
+	// Quoted in text format, because value can contain spaces
+	quoted bool
+	value  func(rec *accessLogRecord, key string, buf []byte) []byte
+}
+
+func appendDuration(buf []byte, d time.Duration) []byte {
+	return strconv.AppendFloat(buf, float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+func appendProtocolLabel(rec *accessLogRecord, buf []byte, label func(info *protocol.Info) string) []byte {
+	if info := protocol.FromContext(rec.request.Context()); info != nil {
+		buf = append(buf, label(info)...)
+	}
+	return buf
+}
+
+// Escapes quotes and control characters of quoted text format values
+func appendTextEscaped(buf []byte, s []byte) []byte {
+	const hex = "0123456789abcdef"
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			buf = append(buf, '\\', c)
+		case c < 0x20 || c == 0x7f:
+			buf = append(buf, '\\', 'x', hex[c>>4], hex[c&0xf])
+		default:
+			buf = append(buf, c)
+		}
+	}
+	return buf
+}
+
+// Escapes spaces and control characters of unquoted text format values, like identity,
+// so they can't split the field or the line
+func appendUnquotedEscaped(buf []byte, s []byte) []byte {
+	const hex = "0123456789abcdef"
+	for _, c := range s {
+		if c == ' ' || isControl(c) {
+			buf = append(buf, '\\', 'x', hex[c>>4], hex[c&0xf])
+		} else {
+			buf = append(buf, c)
+		}
+	}
+	return buf
+}
+
+// Catalog of fields available in access log. Fields with `:` take
+// a parameter, e.g. `header:X-Tenant-ID`.
+var accessLogFields = map[string]accessLogField{
+	"time": {value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return rec.start.AppendFormat(buf, time.RFC3339)
+	}},
+	"remote_addr": {value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		host := rec.request.RemoteAddr
+		if i := strings.LastIndexByte(host, ':'); i > 0 {
+			host = host[:i]
+		}
+		return append(buf, host...)
+	}},
+	// RFC 1413 identity, always "-", for combined log format compatibility
+	"ident": {value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return append(buf, '-')
+	}},
+	"method": {value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return append(buf, rec.request.Method...)
+	}},
+	"path": {quoted: true, value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return append(buf, rec.request.URL.Path...)
+	}},
+	"query": {quoted: true, value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return append(buf, rec.request.URL.RawQuery...)
+	}},
+	"proto": {value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return append(buf, rec.request.Proto...)
+	}},
+	// Address of the listener which accepted the connection
+	"local_addr": {value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		if addr, ok := rec.request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			buf = append(buf, addr.String()...)
+		}
+		return buf
+	}},
+	"host": {value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return append(buf, rec.request.Host...)
+	}},
+	// Protocol labels: h1, h2 or h3, requested upgrade, TLS details and upstream protocol
+	"protocol": {value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return appendProtocolLabel(rec, buf, func(info *protocol.Info) string { return info.Inbound })
+	}},
+	"upgrade": {value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return appendProtocolLabel(rec, buf, func(info *protocol.Info) string { return info.Upgrade })
+	}},
+	"tls_version": {quoted: true, value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return appendProtocolLabel(rec, buf, func(info *protocol.Info) string { return info.TLSVersion })
+	}},
+	"tls_cipher": {value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return appendProtocolLabel(rec, buf, func(info *protocol.Info) string { return info.TLSCipher })
+	}},
+	"upstream_proto": {value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return appendProtocolLabel(rec, buf, func(info *protocol.Info) string { return info.Upstream })
+	}},
+	"request": {quoted: true, value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		buf = append(buf, rec.request.Method...)
+		buf = append(buf, ' ')
+		buf = append(buf, rec.request.RequestURI...)
+		buf = append(buf, ' ')
+		return append(buf, rec.request.Proto...)
+	}},
+	"user_agent": {quoted: true, value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return append(buf, rec.request.UserAgent()...)
+	}},
+	"referer": {quoted: true, value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return append(buf, rec.request.Referer()...)
+	}},
+	"status": {numeric: true, value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return strconv.AppendInt(buf, int64(rec.status), 10)
+	}},
+	"bytes": {numeric: true, value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return strconv.AppendInt(buf, rec.bytes, 10)
+	}},
+	"duration_ms": {numeric: true, value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return appendDuration(buf, rec.duration)
+	}},
+	// Time until response headers were sent
+	"ttfb_ms": {numeric: true, value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return appendDuration(buf, rec.ttfb)
+	}},
+	"identity": {value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return append(buf, rec.subject...)
+	}},
+	"auth_method": {value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		return append(buf, rec.authMethod...)
+	}},
+	// Empty if request was answered before reaching the proxy, e.g. rejected by auth
+	"upstream": {value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		if rec.final == nil {
+			return buf
+		}
+		return append(buf, rec.upstream...)
+	}},
+	"header:": {quoted: true, value: func(rec *accessLogRecord, key string, buf []byte) []byte {
+		return append(buf, rec.request.Header.Get(key)...)
+	}},
+	"response_header:": {quoted: true, value: func(rec *accessLogRecord, key string, buf []byte) []byte {
+		return append(buf, rec.header.Get(key)...)
+	}},
+	// Decision trail, in the same format as X-Debug-Decision headers
+	"decisions": {quoted: true, value: func(rec *accessLogRecord, _ string, buf []byte) []byte {
+		for i, e := range trail.FromContext(rec.request.Context()).Entries() {
+			if i > 0 {
+				buf = append(buf, "; "...)
+			}
+			buf = append(buf, e.String()...)
+		}
+		return buf
+	}},
+	// String values stored in request context, e.g. by plugins
+	"context:": {quoted: true, value: func(rec *accessLogRecord, key string, buf []byte) []byte {
+		if rec.final == nil {
+			return buf
+		}
+		value, _ := rec.final.Context().Value(key).(string)
+		return append(buf, value...)
+	}},
+}
+
+type selectedLogField struct {
+	// Already escaped, to not escape it for every record
+	jsonName []byte
+	catalog  string
+	key      string
+	field    accessLogField
+}
+
+// Parses comma separated list of fields. Each one can be renamed
+// with `name=field` syntax, e.g. `tenant=header:X-Tenant-ID`.
+func parseAccessLogFields(spec string) ([]selectedLogField, error) {
+	var selected []selectedLogField
+	for _, item := range splitList(spec) {
+		name, field := item, item
+		if i := strings.IndexByte(item, '='); i > 0 {
+			name, field = item[:i], item[i+1:]
+		}
+
+		key := ""
+		if i := strings.IndexByte(field, ':'); i > 0 {
+			field, key = field[:i+1], field[i+1:]
+		}
+
+		f, ok := accessLogFields[field]
+		if !ok || (strings.HasSuffix(field, ":") && key == "") {
+			return nil, fmt.Errorf("Unknown access log field '%s'", item)
+		}
+		selected = append(selected, selectedLogField{appendJSONEscaped(nil, []byte(name)), field, key, f})
+	}
+	return selected, nil
+}
+
+// Appends s as JSON string contents, without quotes
+func appendJSONEscaped(buf []byte, s []byte) []byte {
+	const hex = "0123456789abcdef"
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				buf = append(buf, '\\', c)
+			case c < 0x20:
+				buf = append(buf, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			default:
+				buf = append(buf, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf = append(buf, `�`...)
+		} else {
+			buf = append(buf, s[i:i+size]...)
+		}
+		i += size
+	}
+	return buf
+}
+
+type accessLogger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string
+	fields []selectedLogField
+}
+
+var accessLogBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 1024)
+		return &buf
+	},
+}
+
+func (l *accessLogger) write(rec *accessLogRecord) {
+	linePtr := accessLogBuffers.Get().(*[]byte)
+	valuePtr := accessLogBuffers.Get().(*[]byte)
+	line, value := (*linePtr)[:0], (*valuePtr)[:0]
+
+	if l.format == AccessLogJSON {
+		line = append(line, '{')
+	}
+	for i, f := range l.fields {
+		value = truncateValue(f.field.value(rec, f.key, value[:0]))
+
+		if l.format == AccessLogJSON {
+			if i > 0 {
+				line = append(line, ',')
+			}
+			line = append(line, '"')
+			line = append(line, f.jsonName...)
+			line = append(line, '"', ':')
+			if f.field.numeric {
+				line = append(line, value...)
+			} else {
+				line = append(line, '"')
+				line = appendJSONEscaped(line, value)
+				line = append(line, '"')
+			}
+			continue
+		}
+
+		if i > 0 {
+			line = append(line, ' ')
+		}
+		switch {
+		case f.catalog == "time":
+			line = append(line, '[')
+			line = rec.start.AppendFormat(line, "02/Jan/2006:15:04:05 -0700")
+			line = append(line, ']')
+		case f.field.quoted && len(value) == 0:
+			line = append(line, `"-"`...)
+		case f.field.quoted:
+			line = append(line, '"')
+			line = appendTextEscaped(line, value)
+			line = append(line, '"')
+		case len(value) == 0:
+			line = append(line, '-')
+		default:
+			line = appendUnquotedEscaped(line, value)
+		}
+	}
+	if l.format == AccessLogJSON {
+		line = append(line, '}')
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	l.out.Write(line)
+	l.mu.Unlock()
+
+	*linePtr, *valuePtr = line, value
+	accessLogBuffers.Put(linePtr)
+	accessLogBuffers.Put(valuePtr)
+}
+
+// Record and writer of a request, reused by following requests once it is logged
+type accessLogEntry struct {
+	rec    accessLogRecord
+	writer accessLogWriter
+}
+
+var accessLogEntries = sync.Pool{
+	New: func() interface{} {
+		return &accessLogEntry{}
+	},
+}
+
+// Records status, size and time to first byte of the response
+type accessLogWriter struct {
+	http.ResponseWriter
+	rec         *accessLogRecord
+	wroteHeader bool
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= 200 {
+		w.wroteHeader = true
+		w.rec.status = code
+		w.rec.ttfb = time.Since(w.rec.start)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.rec.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Records identity of the request for access log, called by auth middlewares
+func setAccessLogIdentity(r *http.Request, subject, method string) {
+	if rec, ok := r.Context().Value(accessLogContextKey{}).(*accessLogRecord); ok {
+		rec.subject, rec.authMethod = subject, method
+	}
+}
+
+// Remembers request as it reaches the end of the chain, so access log can read context
+// values added by middlewares and plugins. Should be last in the chain.
+func AccessLogCapture() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if rec, ok := r.Context().Value(accessLogContextKey{}).(*accessLogRecord); ok {
+				rec.final = r
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Writes access log record for every request to "stdout", or to a file at given path,
+// in json or text format, with fields selected from the catalog. In text format
+// default fields produce Apache combined log format.
+// Should be first in the chain, to log requests rejected by other middlewares too.
+func AccessLog(output, format, fields string, upstream *ProxyTarget) Middleware {
+	if output == "" {
+		return nil
+	}
+
+	if format != AccessLogJSON && format != AccessLogText {
+		log.Fatal("Access log format should be 'json' or 'text' ", format)
+	}
+	if fields == "" && format == AccessLogJSON {
+		fields = jsonLogFields
+	} else if fields == "" {
+		fields = combinedLogFields
+	}
+	selected, err := parseAccessLogFields(fields)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var out io.Writer = os.Stdout
+	if output != "stdout" {
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal("Can't open access log ", err)
+		}
+		out = f
+	}
+	logger := &accessLogger{out: out, format: format, fields: selected}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			entry := accessLogEntries.Get().(*accessLogEntry)
+			rec, aw := &entry.rec, &entry.writer
+			// Kept in request state, if there is one, to not add context layer
+			state := requestStateOf(r)
+			if state != nil && state.accessLog == nil {
+				state.accessLog = rec
+			} else {
+				state = nil
+				r = r.WithContext(context.WithValue(r.Context(), accessLogContextKey{}, rec))
+			}
+			*rec = accessLogRecord{start: time.Now(), request: r, header: w.Header(), upstream: upstream.Label()}
+			*aw = accessLogWriter{ResponseWriter: w, rec: rec}
+
+			// Written even if handler panics, e.g. when aborting response
+			completed := false
+			defer func() {
+				// Nothing written means implicit 200, unless response was aborted
+				if completed && rec.status == 0 {
+					rec.status = http.StatusOK
+				}
+				rec.duration = time.Since(rec.start)
+				logger.write(rec)
+
+				if state != nil {
+					state.accessLog = nil
+				}
+				*entry = accessLogEntry{}
+				accessLogEntries.Put(entry)
+			}()
+			h.ServeHTTP(aw, r)
+			completed = true
+		})
+	}
+}
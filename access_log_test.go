@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogWrite(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		fields string
+		want   string
+	}{
+		{"combined", AccessLogText, "", `192.0.2.1 - alice [15/Oct/2026:10:00:00 +0000] "GET /a?b=c HTTP/1.1" 404 5 "-" "agent \"x\""`},
+		{"json", AccessLogJSON, "status,identity,path,tenant=header:X-Tenant", `{"status":404,"identity":"alice","path":"/a","tenant":"t\u0001"}`},
+		{"escaped identity", AccessLogText, "identity", `alice\x20\x0a`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := tt.fields
+			if fields == "" {
+				fields = combinedLogFields
+			}
+			selected, err := parseAccessLogFields(fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			logger := &accessLogger{out: &out, format: tt.format, fields: selected}
+
+			r := httptest.NewRequest("GET", "/a?b=c", nil)
+			r.Header.Set("User-Agent", `agent "x"`)
+			r.Header.Set("X-Tenant", "t\x01")
+			subject := "alice"
+			if tt.name == "escaped identity" {
+				subject = "alice \n"
+			}
+			logger.write(&accessLogRecord{
+				start:   time.Date(2026, 10, 15, 10, 0, 0, 0, time.UTC),
+				request: r,
+				header:  http.Header{},
+				status:  http.StatusNotFound,
+				bytes:   5,
+				subject: subject,
+			})
+			if got := strings.TrimSuffix(out.String(), "\n"); got != tt.want {
+				t.Errorf("line = %s\nwant   %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkAccessLog(b *testing.B) {
+	selected, err := parseAccessLogFields(jsonLogFields)
+	if err != nil {
+		b.Fatal(err)
+	}
+	logger := &accessLogger{out: &bytes.Buffer{}, format: AccessLogJSON, fields: selected}
+	rec := &accessLogRecord{
+		start:   time.Now(),
+		request: httptest.NewRequest("GET", "/a?b=c", nil),
+		header:  http.Header{},
+		status:  http.StatusOK,
+		bytes:   1024,
+		subject: "alice",
+	}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		logger.out.(*bytes.Buffer).Reset()
+		logger.write(rec)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const pluginAdminPrefix = "/__proxy/plugins/"
+
+// Admin handlers are served on a separate listener, so they never leak through the proxy.
+// Restrict access to it by binding it to a private address.
+var adminMux = http.NewServeMux()
+
+type PluginInfo struct {
+	Name        string   `json:"name"`
+	Path        string   `json:"path"`
+	Hooks       []string `json:"hooks"`
+	Exports     []string `json:"exports"`
+	Problems    []string `json:"problems,omitempty"`
+	AdminRoutes []string `json:"admin_routes,omitempty"`
+
+	InitDuration time.Duration `json:"init_duration_ns"`
+	InitError    string        `json:"init_error,omitempty"`
+
+	preflighted bool
+}
+
+var pluginInventory struct {
+	sync.Mutex
+	plugins []*PluginInfo
+	routes  map[string]string
+}
+
+// Returns inventory entry of the plugin, adding it if needed. Caller holds the lock.
+func pluginEntry(path string) *PluginInfo {
+	for _, info := range pluginInventory.plugins {
+		if info.Path == path {
+			return info
+		}
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	info := &PluginInfo{Name: name, Path: path}
+	pluginInventory.plugins = append(pluginInventory.plugins, info)
+	return info
+}
+
+// Records plugin hook in the inventory. When plugin is seen first time, checks its exports
+// against hook catalog, and mounts handlers returned by its optional
+// `AdminRoutes() map[string]http.HandlerFunc` function under /__proxy/plugins/<plugin-name>/
+// on admin listener.
+func registerPlugin(path string, hook string) {
+	pluginInventory.Lock()
+	defer pluginInventory.Unlock()
+
+	info := pluginEntry(path)
+	info.Hooks = append(info.Hooks, hook)
+	if len(info.Hooks) > 1 {
+		return
+	}
+	checkPluginExports(info)
+
+	symbol, err := LoadPlugin(path, "AdminRoutes")
+	if err != nil {
+		// Admin routes are optional
+		return
+	}
+	adminRoutes, ok := symbol.(func() map[string]http.HandlerFunc)
+	if !ok {
+		// Already reported by preflight
+		return
+	}
+
+	mountAdminRoutes(info, adminRoutes())
+}
+
+// Handlers of one admin path by method, answering other methods with 405
+type methodHandlers map[string]http.Handler
+
+func (m methodHandlers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h, found := m[r.Method]; found {
+		h.ServeHTTP(w, r)
+		return
+	}
+	if h, found := m[http.MethodGet]; found && r.Method == http.MethodHead {
+		h.ServeHTTP(w, r)
+		return
+	}
+	methods := make([]string, 0, len(m))
+	for method := range m {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	allowMethods(w, r, methods...)
+}
+
+// Splits plugin admin route, like `/stats` or `GET /stats`, into method and path. Methods are
+// matched by the proxy rather than by ServeMux, which does not know them in legacy mode.
+func parseAdminRoute(route string) (method, path string, err error) {
+	path = route
+	if m, p, found := strings.Cut(route, " "); found {
+		method, path = m, strings.TrimLeft(p, " ")
+		if method == "" || strings.TrimLeft(method, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") != "" {
+			return "", "", fmt.Errorf("method should be upper case, like GET, got %q", method)
+		}
+	}
+	if strings.ContainsAny(path, " \t{}") {
+		return "", "", fmt.Errorf("path should not contain spaces or wildcards, got %q", path)
+	}
+	return method, "/" + strings.TrimPrefix(path, "/"), nil
+}
+
+// Mounts plugin admin routes under its prefix. Caller holds inventory lock.
+func mountAdminRoutes(info *PluginInfo, routes map[string]http.HandlerFunc) {
+	if pluginInventory.routes == nil {
+		pluginInventory.routes = make(map[string]string)
+	}
+	pluginPrefix := pluginAdminPrefix + info.Name
+
+	byPattern := make(map[string]methodHandlers)
+	for route, handler := range routes {
+		method, path, err := parseAdminRoute(route)
+		if err != nil {
+			log.Fatal("Admin route '", route, "' of plugin ", info.Path, " is invalid: ", err)
+		}
+		pattern := pluginPrefix + path
+		if byPattern[pattern] == nil {
+			byPattern[pattern] = make(methodHandlers)
+		}
+		if _, found := byPattern[pattern][method]; found {
+			log.Fatal("Admin route '", route, "' of plugin ", info.Path, " is listed twice")
+		}
+		byPattern[pattern][method] = handler
+	}
+
+	for pattern, handlers := range byPattern {
+		if owner, found := pluginInventory.routes[pattern]; found {
+			log.Fatal("Admin route ", pattern, " of plugin ", info.Path, " is already registered by ", owner)
+		}
+		var handler http.Handler = handlers
+		if h, found := handlers[""]; found {
+			if len(handlers) > 1 {
+				log.Fatal("Admin route ", pattern, " of plugin ", info.Path, " is listed both with and without method")
+			}
+			handler = h
+		}
+
+		// Plugin sees paths relative to its own prefix
+		if err := handleAdminRoute(pattern, http.StripPrefix(pluginPrefix, handler)); err != nil {
+			log.Fatal("Admin route ", pattern, " of plugin ", info.Path, " is invalid: ", err)
+		}
+		pluginInventory.routes[pattern] = info.Path
+		for method := range handlers {
+			info.AdminRoutes = append(info.AdminRoutes, strings.TrimSpace(method+" "+pattern))
+		}
+	}
+	sort.Strings(info.AdminRoutes)
+}
+
+// ServeMux panics on invalid or conflicting patterns, they are returned as errors instead
+func handleAdminRoute(pattern string, handler http.Handler) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("%v", p)
+		}
+	}()
+	adminMux.Handle(pattern, handler)
+	return nil
+}
+
+// Copy of inventory, safe to use while new plugins are registered
+func pluginsSnapshot() []PluginInfo {
+	pluginInventory.Lock()
+	defer pluginInventory.Unlock()
+
+	plugins := make([]PluginInfo, len(pluginInventory.plugins))
+	for i, info := range pluginInventory.plugins {
+		plugins[i] = *info
+	}
+	return plugins
+}
+
+func pluginInventoryHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	pluginInventory.Lock()
+	defer pluginInventory.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pluginInventory.plugins)
+}
+
+func varsHandler(w http.ResponseWriter, r *http.Request) {
+	if allowMethods(w, r, http.MethodGet) {
+		expvar.Handler().ServeHTTP(w, r)
+	}
+}
+
+// Rejects requests from addresses outside of comma separated list of IPs and CIDR ranges,
+// e.g. `10.0.0.0/8,127.0.0.1`, with 403. Allows everyone if list is empty.
+func AllowClients(allow string) Middleware {
+	var prefixes []netip.Prefix
+	for _, item := range splitList(allow) {
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(item)
+			if addrErr != nil {
+				log.Fatal("Allowed client should be an IP or CIDR range ", item)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	if len(prefixes) == 0 {
+		return nil
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+				addr := addrPort.Addr().Unmap()
+				for _, prefix := range prefixes {
+					if prefix.Contains(addr) {
+						h.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+			http.Error(w, "Forbidden", http.StatusForbidden)
+		})
+	}
+}
+
+// Serves expvar counters, readiness, lifecycle events, routes, feature flags, plugin inventory
+// and plugin admin routes. Middlewares, like client address restrictions and auth, wrap
+// every admin route, including the ones plugins add.
+func ServeAdmin(addr string, ready http.Handler, mws ...Middleware) {
+	if addr == "" {
+		return
+	}
+
+	adminMux.HandleFunc("/debug/vars", varsHandler)
+	adminMux.Handle("/readyz", ready)
+	adminMux.Handle("/__proxy/lifecycle", lifecycle)
+	adminMux.HandleFunc("/__proxy/plugins", pluginInventoryHandler)
+	adminMux.HandleFunc("/__proxy/routes", routesHandler)
+	adminMux.HandleFunc(featureFlagsAdminPath, featureFlagsHandler)
+	adminMux.HandleFunc(featureFlagsAdminPath+"/", featureFlagsHandler)
+	adminMux.HandleFunc(archiveAdminPath, archiveHandler)
+
+	go func() {
+		log.Fatal(http.ListenAndServe(addr, Chain(adminMux, mws...)))
+	}()
+}
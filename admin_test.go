@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPluginAdminRoutes(t *testing.T) {
+	echoPath := func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}
+	info := &PluginInfo{Name: "admintest", Path: "admintest.so"}
+	pluginInventory.Lock()
+	mountAdminRoutes(info, map[string]http.HandlerFunc{
+		"GET /stats":    echoPath,
+		"DELETE /stats": echoPath,
+		"/reset":        echoPath,
+	})
+	pluginInventory.Unlock()
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		body   string
+	}{
+		{http.MethodGet, "/__proxy/plugins/admintest/stats", http.StatusOK, "/stats"},
+		{http.MethodHead, "/__proxy/plugins/admintest/stats", http.StatusOK, ""},
+		{http.MethodDelete, "/__proxy/plugins/admintest/stats", http.StatusOK, "/stats"},
+		{http.MethodPost, "/__proxy/plugins/admintest/stats", http.StatusMethodNotAllowed, ""},
+		{http.MethodPost, "/__proxy/plugins/admintest/reset", http.StatusOK, "/reset"},
+		{http.MethodGet, "/__proxy/plugins/admintest/missing", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		adminMux.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, w.Code, tt.status)
+		}
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("%s %s: body %q, want %q", tt.method, tt.path, w.Body.String(), tt.body)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	adminMux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/__proxy/plugins/admintest/stats", nil))
+	if allow := w.Header().Get("Allow"); allow != "DELETE, GET, HEAD, OPTIONS" {
+		t.Errorf("Allow %q", allow)
+	}
+
+	want := "/__proxy/plugins/admintest/reset DELETE /__proxy/plugins/admintest/stats GET /__proxy/plugins/admintest/stats"
+	if got := strings.Join(info.AdminRoutes, " "); got != want {
+		t.Errorf("admin routes %q, want %q", got, want)
+	}
+}
+
+func TestParseAdminRoute(t *testing.T) {
+	tests := []struct {
+		route  string
+		method string
+		path   string
+		err    bool
+	}{
+		{"/stats", "", "/stats", false},
+		{"stats", "", "/stats", false},
+		{"GET /stats", "GET", "/stats", false},
+		{"POST  stats/", "POST", "/stats/", false},
+		{"get /stats", "", "", true},
+		{" /stats", "", "", true},
+		{"GET /a b", "", "", true},
+		{"/items/{id}", "", "", true},
+	}
+	for _, tt := range tests {
+		method, path, err := parseAdminRoute(tt.route)
+		if (err != nil) != tt.err {
+			t.Errorf("%q: error %v", tt.route, err)
+			continue
+		}
+		if method != tt.method || path != tt.path {
+			t.Errorf("%q: got %q %q, want %q %q", tt.route, method, path, tt.method, tt.path)
+		}
+	}
+}
+
+func TestHandleAdminRouteInvalid(t *testing.T) {
+	if err := handleAdminRoute("/__proxy/plugins/admintest/twice", http.NotFoundHandler()); err != nil {
+		t.Fatal(err)
+	}
+	for _, pattern := range []string{"", "/__proxy/plugins/admintest/twice"} {
+		if err := handleAdminRoute(pattern, http.NotFoundHandler()); err == nil {
+			t.Errorf("%q: expected error", pattern)
+		}
+	}
+}
+
+func TestAdminAccess(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := Chain(ok, AllowClients("10.0.0.0/8, 127.0.0.1,::1"), BasicAuth("admin", LoadSecret("admin-basic-password", "secret")))
+
+	tests := []struct {
+		name     string
+		remote   string
+		login    string
+		password string
+		status   int
+	}{
+		{"allowed range", "10.1.2.3:5000", "admin", "secret", http.StatusOK},
+		{"allowed address", "127.0.0.1:5000", "admin", "secret", http.StatusOK},
+		{"allowed IPv6", "[::1]:5000", "admin", "secret", http.StatusOK},
+		{"mapped IPv4", "[::ffff:10.0.0.1]:5000", "admin", "secret", http.StatusOK},
+		{"other address", "192.0.2.1:5000", "admin", "secret", http.StatusForbidden},
+		{"no credentials", "10.1.2.3:5000", "", "", http.StatusUnauthorized},
+		{"wrong password", "10.1.2.3:5000", "admin", "wrong", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/__proxy/plugins/admintest/stats", nil)
+			r.RemoteAddr = tt.remote
+			if tt.login != "" {
+				r.SetBasicAuth(tt.login, tt.password)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+
+	if AllowClients("") != nil {
+		t.Error("empty allow list should disable restriction")
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/TykTechnologies/go-plugins-template/trail"
+)
+
+const archiveAdminPath = "/__proxy/archive"
+
+// Records waiting to be written, samples beyond it are dropped
+const archiveQueueSize = 64
+
+// Bodies of requests which are not sampled are captured only up to this size,
+// in case they get 5xx response
+const archiveUnsampledBodySize = 4 << 10
+
+var (
+	archivedRequests = expvar.NewInt("archived_requests")
+	archiveDropped   = expvar.NewInt("archive_dropped")
+)
+
+// Archive captures bodies of every request, so it has its own budget, limit is set by
+// -archive-buffer-budget. Shared budget stays for features like JSON redaction.
+var archiveBuffers = &bufferBudget{usedMetric: expvar.NewInt("archive_buffer_used"), exhaustedMetric: expvar.NewInt("archive_buffer_exhausted")}
+
+// Headers with credentials are never archived
+var archiveRedactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Debug-Secret"}
+
+// Next requests to sample regardless of rate, set through admin API
+var archiveForced struct {
+	sync.Mutex
+	remaining int
+	prefix    string
+}
+
+// Takes forced sample, if there is one left for the path
+func takeForcedSample(path string) bool {
+	archiveForced.Lock()
+	defer archiveForced.Unlock()
+	if archiveForced.remaining == 0 || !strings.HasPrefix(path, archiveForced.prefix) {
+		return false
+	}
+	archiveForced.remaining--
+	return true
+}
+
+// Captures up to limit bytes of a body. Archive budget is reserved for bytes actually
+// captured, and capture stops once it is exhausted. Transport can still read request
+// body after the handler returned, so capture is locked.
+type bodyCapture struct {
+	mu        sync.Mutex
+	buf       *bytes.Buffer
+	limit     int64
+	reserved  int64
+	truncated bool
+	omitted   bool
+}
+
+func (c *bodyCapture) write(p []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.omitted || c.truncated || len(p) == 0 {
+		return
+	}
+	if room := c.limit - c.reserved; int64(len(p)) > room {
+		p, c.truncated = p[:room], true
+	}
+	if len(p) == 0 {
+		return
+	}
+	if !archiveBuffers.reserve(int64(len(p))) {
+		if c.buf == nil {
+			c.omitted = true
+		} else {
+			c.truncated = true
+		}
+		return
+	}
+	c.reserved += int64(len(p))
+	if c.buf == nil {
+		c.buf = getBuffer()
+	}
+	c.buf.Write(p)
+}
+
+func (c *bodyCapture) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Late writes are not captured anymore
+	c.omitted = true
+	if c.buf != nil {
+		putBuffer(c.buf)
+		c.buf = nil
+	}
+	if c.reserved > 0 {
+		archiveBuffers.release(c.reserved)
+		c.reserved = 0
+	}
+}
+
+type archiveBody struct {
+	io.ReadCloser
+	capture *bodyCapture
+}
+
+func (b archiveBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.capture.write(p[:n])
+	return n, err
+}
+
+type archiveWriter struct {
+	http.ResponseWriter
+	status  int
+	capture *bodyCapture
+}
+
+func (w *archiveWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *archiveWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.capture.write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *archiveWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+var archiveWriters = sync.Pool{
+	New: func() interface{} {
+		return &archiveWriter{}
+	},
+}
+
+type archiveRecord struct {
+	Time       time.Time `json:"time"`
+	Reason     string    `json:"reason"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	Proto      string    `json:"proto"`
+	RemoteAddr string    `json:"remote_addr"`
+	DurationMs float64   `json:"duration_ms"`
+	Decisions  []string  `json:"decisions,omitempty"`
+
+	RequestHeader  http.Header  `json:"request_headers"`
+	Request        archivedBody `json:"request"`
+	Status         int          `json:"status"`
+	ResponseHeader http.Header  `json:"response_headers"`
+	Response       archivedBody `json:"response"`
+
+	// Captures are released once record is written
+	captures []*bodyCapture
+}
+
+type archivedBody struct {
+	Body      string `json:"body,omitempty"`
+	Encoding  string `json:"encoding,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+	Omitted   string `json:"omitted,omitempty"`
+}
+
+func archiveHeader(header http.Header) http.Header {
+	archived := header.Clone()
+	for _, name := range archiveRedactedHeaders {
+		if _, ok := archived[name]; ok {
+			archived[name] = []string{"[redacted]"}
+		}
+	}
+	return archived
+}
+
+// Applies JSON redaction rules to body. Bodies which can't be redacted, e.g. truncated,
+// encoded or malformed JSON, are omitted instead.
+func archiveBodyOf(capture *bodyCapture, header http.Header, rules []redactRule) archivedBody {
+	capture.mu.Lock()
+	defer capture.mu.Unlock()
+	switch {
+	case capture.omitted:
+		return archivedBody{Omitted: "buffer budget exhausted"}
+	case capture.buf == nil:
+		return archivedBody{}
+	}
+	body := capture.buf.Bytes()
+
+	if len(rules) > 0 && isJSON(header) {
+		encoding := header.Get("Content-Encoding")
+		if capture.truncated || (encoding != "" && encoding != "identity") {
+			return archivedBody{Truncated: capture.truncated, Omitted: "can't be redacted"}
+		}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		var doc interface{}
+		if err := decoder.Decode(&doc); err != nil {
+			return archivedBody{Omitted: "can't be redacted"}
+		}
+		for _, rule := range rules {
+			applyRedaction(doc, rule.pointer, rule.action, rule.key)
+		}
+		redacted, _ := json.Marshal(doc)
+		return archivedBody{Body: string(redacted)}
+	}
+
+	if utf8.Valid(body) {
+		return archivedBody{Body: string(body), Truncated: capture.truncated}
+	}
+	return archivedBody{Body: base64.StdEncoding.EncodeToString(body), Encoding: "base64", Truncated: capture.truncated}
+}
+
+// Writes archived records to spool directory, one gzip compressed JSON file each,
+// removing the oldest ones once total size exceeds maxSize
+type archiveSpool struct {
+	dir     string
+	maxSize int64
+	rules   []redactRule
+	records chan *archiveRecord
+	// Spooled files, oldest first
+	files []string
+	sizes map[string]int64
+	total int64
+}
+
+func (s *archiveSpool) scan() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json.gz") {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			s.add(entry.Name(), info.Size())
+		}
+	}
+	sort.Strings(s.files)
+	return nil
+}
+
+func (s *archiveSpool) add(name string, size int64) {
+	s.files = append(s.files, name)
+	s.sizes[name] = size
+	s.total += size
+}
+
+func (s *archiveSpool) write(rec *archiveRecord) error {
+	defer func() {
+		for _, capture := range rec.captures {
+			capture.release()
+		}
+	}()
+	rec.Request = archiveBodyOf(rec.captures[0], rec.RequestHeader, s.rules)
+	rec.Response = archiveBodyOf(rec.captures[1], rec.ResponseHeader, s.rules)
+	rec.RequestHeader = archiveHeader(rec.RequestHeader)
+	rec.ResponseHeader = archiveHeader(rec.ResponseHeader)
+
+	// Names sort by time, so the oldest files are removed first
+	name := fmt.Sprintf("%020d-%04d.json.gz", rec.Time.UnixNano(), rand.Intn(10000))
+	tmp := filepath.Join(s.dir, "."+name+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	encoder := json.NewEncoder(zw)
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(rec)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(s.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if info, err := os.Stat(filepath.Join(s.dir, name)); err == nil {
+		s.add(name, info.Size())
+	}
+	for s.total > s.maxSize && len(s.files) > 1 {
+		oldest := s.files[0]
+		if err := os.Remove(filepath.Join(s.dir, oldest)); err != nil && !os.IsNotExist(err) {
+			log.Println("Can't remove archived request", err)
+			break
+		}
+		s.total -= s.sizes[oldest]
+		delete(s.sizes, oldest)
+		s.files = s.files[1:]
+	}
+	archivedRequests.Add(1)
+	return nil
+}
+
+func (s *archiveSpool) run() {
+	for rec := range s.records {
+		if err := s.write(rec); err != nil {
+			log.Println("Can't archive request", err)
+		}
+	}
+}
+
+// Archives complete request and response pairs, with bodies up to maxBody bytes, for rate
+// fraction of requests, every 5xx response, and requests forced through admin API.
+// Bodies of 5xx responses to requests which were not sampled are kept up to 4KB.
+// Records are written to dir in the background, and dropped if writing falls behind.
+// JSON redaction rules apply to archived bodies, and credential headers are never archived.
+// Should be placed right after DecisionTrail, so sampling decision is recorded early.
+func BodyArchive(dir string, rate float64, maxBody, maxSize int64, redactSpec string, hashKey *Secret) Middleware {
+	if dir == "" {
+		return nil
+	}
+	rules, err := parseRedactRules(redactSpec, hashKey)
+	if err != nil {
+		log.Fatal("Can't parse JSON redaction rules ", err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Fatal("Can't create archive directory ", err)
+	}
+	spool := &archiveSpool{dir: dir, maxSize: maxSize, rules: rules, records: make(chan *archiveRecord, archiveQueueSize), sizes: make(map[string]int64)}
+	if err := spool.scan(); err != nil {
+		log.Fatal("Can't read archive directory ", err)
+	}
+	go spool.run()
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			reason := ""
+			switch {
+			case takeForcedSample(r.URL.Path):
+				reason = "forced"
+			case rand.Float64() < rate:
+				reason = "rate"
+			}
+			if reason != "" {
+				recordDecision(r, "archive", "sample", reason)
+			} else {
+				recordDecision(r, "archive", "skip", "rate "+strconv.FormatFloat(rate, 'f', -1, 64))
+			}
+
+			// Bodies are captured for every request, as 5xx responses are archived too
+			limit := maxBody
+			if reason == "" && limit > archiveUnsampledBodySize {
+				limit = archiveUnsampledBodySize
+			}
+			requestBody := &bodyCapture{limit: limit}
+			responseBody := &bodyCapture{limit: limit}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = archiveBody{r.Body, requestBody}
+			}
+			aw := archiveWriters.Get().(*archiveWriter)
+			*aw = archiveWriter{ResponseWriter: w, capture: responseBody}
+
+			defer func() {
+				status := aw.status
+				*aw = archiveWriter{}
+				archiveWriters.Put(aw)
+
+				if reason == "" && status >= 500 {
+					reason = "5xx"
+				}
+				if reason == "" {
+					requestBody.release()
+					responseBody.release()
+					return
+				}
+
+				var decisions []string
+				for _, e := range trail.FromContext(r.Context()).Entries() {
+					decisions = append(decisions, e.String())
+				}
+				rec := &archiveRecord{
+					Time:           start,
+					Reason:         reason,
+					Method:         r.Method,
+					URL:            r.URL.String(),
+					Proto:          r.Proto,
+					RemoteAddr:     r.RemoteAddr,
+					DurationMs:     float64(time.Since(start)) / float64(time.Millisecond),
+					Decisions:      decisions,
+					RequestHeader:  r.Header.Clone(),
+					Status:         status,
+					ResponseHeader: w.Header().Clone(),
+					captures:       []*bodyCapture{requestBody, responseBody},
+				}
+				select {
+				case spool.records <- rec:
+				default:
+					archiveDropped.Add(1)
+					requestBody.release()
+					responseBody.release()
+				}
+			}()
+
+			h.ServeHTTP(aw, r)
+		})
+	}
+}
+
+// Forces sampling of the next requests on POST /__proxy/archive?count=<n>&path=<prefix>,
+// and reports how many are left on GET
+func archiveHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		count, err := strconv.Atoi(r.URL.Query().Get("count"))
+		if err != nil || count < 0 {
+			http.Error(w, "count should be a non negative number", http.StatusBadRequest)
+			return
+		}
+		archiveForced.Lock()
+		archiveForced.remaining, archiveForced.prefix = count, r.URL.Query().Get("path")
+		archiveForced.Unlock()
+		log.Printf("Forced archiving of next %d requests to %q by %s", count, r.URL.Query().Get("path"), r.RemoteAddr)
+	}
+
+	// Every proxied request takes the lock, so it is not held while writing to admin client
+	archiveForced.Lock()
+	state := map[string]interface{}{"remaining": archiveForced.remaining, "path": archiveForced.prefix}
+	archiveForced.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state)
+}
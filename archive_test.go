@@ -0,0 +1,229 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func readArchive(t *testing.T, dir string) []archiveRecord {
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json.gz"))
+	var records []archiveRecord
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rec archiveRecord
+		if err := json.NewDecoder(zr).Decode(&rec); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		records = append(records, rec)
+	}
+	return records
+}
+
+// Records are written in the background
+func waitArchive(t *testing.T, dir string) []archiveRecord {
+	var records []archiveRecord
+	for i := 0; i < 100 && len(records) == 0; i++ {
+		records = readArchive(t, dir)
+		if len(records) == 0 {
+			<-time.After(10 * time.Millisecond)
+		}
+	}
+	return records
+}
+
+func forceArchive(t *testing.T, query string) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	archiveHandler(w, httptest.NewRequest("POST", archiveAdminPath+"?"+query, nil))
+	var state map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &state)
+	return w.Code, state
+}
+
+// Archiving every request must not take buffers JSON redaction relies on
+func TestBodyArchiveBudget(t *testing.T) {
+	dir := t.TempDir()
+	var sharedUsed, archiveUsed int64
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf := make([]byte, 100)
+		r.Body.Read(buf)
+		w.Write([]byte(`{"ok":true}`))
+		atomic.StoreInt64(&sharedUsed, atomic.LoadInt64(&buffers.used))
+		atomic.StoreInt64(&archiveUsed, atomic.LoadInt64(&archiveBuffers.used))
+	}), DecisionTrail(), BodyArchive(dir, 0, 64<<10, 1<<20, "", nil))
+
+	r := httptest.NewRequest("POST", "/a", strings.NewReader("0123456789"))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if sharedUsed != 0 {
+		t.Errorf("shared buffer budget used = %d, want 0", sharedUsed)
+	}
+	// Only captured bytes are reserved, not the whole body limit
+	if want := int64(len("0123456789") + len(`{"ok":true}`)); archiveUsed != want {
+		t.Errorf("archive buffer budget used = %d, want %d", archiveUsed, want)
+	}
+	if used := atomic.LoadInt64(&archiveBuffers.used); used != 0 {
+		t.Errorf("archive buffer budget used after request = %d, want 0", used)
+	}
+}
+
+func TestBodyArchive5xx(t *testing.T) {
+	dir := t.TempDir()
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(`{"ssn":"123456789"}`))
+	}), DecisionTrail(), BodyArchive(dir, 0, 64<<10, 1<<20, "/ssn=mask", nil))
+
+	r := httptest.NewRequest("GET", "/a", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	records := waitArchive(t, dir)
+	if len(records) != 1 {
+		t.Fatalf("archived %d records, want 1", len(records))
+	}
+	rec := records[0]
+	if rec.Reason != "5xx" || rec.Status != http.StatusBadGateway {
+		t.Errorf("reason %q status %d, want 5xx 502", rec.Reason, rec.Status)
+	}
+	if rec.Response.Body != `{"ssn":"*****6789"}` {
+		t.Errorf("response body %q is not redacted", rec.Response.Body)
+	}
+	if got := rec.RequestHeader.Get("Authorization"); got != "[redacted]" {
+		t.Errorf("Authorization archived as %q", got)
+	}
+}
+
+func TestArchiveForcedSample(t *testing.T) {
+	t.Cleanup(func() { forceArchive(t, "count=0") })
+
+	if status, state := forceArchive(t, "count=2&path=/a"); status != http.StatusOK || state["remaining"] != 2.0 || state["path"] != "/a" {
+		t.Fatalf("status %d, state %v", status, state)
+	}
+	if takeForcedSample("/b") {
+		t.Error("forced sample taken by path outside of prefix")
+	}
+	if !takeForcedSample("/a/1") || !takeForcedSample("/a") {
+		t.Error("forced sample is not taken")
+	}
+	if takeForcedSample("/a") {
+		t.Error("forced sample taken after count is used up")
+	}
+
+	w := httptest.NewRecorder()
+	archiveHandler(w, httptest.NewRequest("GET", archiveAdminPath, nil))
+	if !strings.Contains(w.Body.String(), `"remaining":0`) {
+		t.Errorf("state after samples %s", w.Body.String())
+	}
+
+	forceArchive(t, "count=5")
+	if status, _ := forceArchive(t, "count=0"); status != http.StatusOK || takeForcedSample("/a") {
+		t.Error("count=0 does not stop forced sampling")
+	}
+	for _, query := range []string{"count=-1", "count=a", ""} {
+		if status, _ := forceArchive(t, query); status != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", query, status)
+		}
+	}
+}
+
+// Forced record is read back from the spool with redacted bodies and without credentials
+func TestBodyArchiveForced(t *testing.T) {
+	dir := t.TempDir()
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Write([]byte(`{"ssn":"987654321","name":"a"}`))
+	}), DecisionTrail(), BodyArchive(dir, 0, 64<<10, 1<<20, "/ssn=mask", nil))
+	t.Cleanup(func() { forceArchive(t, "count=0") })
+	forceArchive(t, "count=1&path=/forced")
+
+	r := httptest.NewRequest("POST", "/forced", strings.NewReader(`{"ssn":"123456789"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Basic secret")
+	r.Header.Set("Cookie", "session=secret")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	records := waitArchive(t, dir)
+	if len(records) != 1 {
+		t.Fatalf("archived %d records, want 1", len(records))
+	}
+	rec := records[0]
+	if rec.Reason != "forced" {
+		t.Errorf("reason %q, want forced", rec.Reason)
+	}
+	if rec.Request.Body != `{"ssn":"*****6789"}` {
+		t.Errorf("request body %q is not redacted", rec.Request.Body)
+	}
+	if rec.Response.Body != `{"name":"a","ssn":"*****4321"}` {
+		t.Errorf("response body %q is not redacted", rec.Response.Body)
+	}
+	for _, header := range []http.Header{rec.RequestHeader, rec.ResponseHeader} {
+		for _, name := range []string{"Authorization", "Cookie", "Set-Cookie"} {
+			if value := header.Get(name); value != "" && value != "[redacted]" {
+				t.Errorf("%s archived as %q", name, value)
+			}
+		}
+	}
+}
+
+// The oldest records are removed once spool is over its size, including records left by previous runs
+func TestArchiveSpoolRetention(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2026, 1, 1, 0, 0, 0, 123456789, time.UTC)
+	write := func(spool *archiveSpool, i int) {
+		rec := &archiveRecord{Time: start.Add(time.Duration(i) * time.Second), URL: "/a", captures: []*bodyCapture{{}, {}}}
+		if err := spool.write(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := func() []string {
+		names, _ := filepath.Glob(filepath.Join(dir, "*.json.gz"))
+		return names
+	}
+
+	spool := &archiveSpool{dir: dir, maxSize: 1 << 20, sizes: make(map[string]int64)}
+	write(spool, 0)
+	size := spool.total
+
+	// Room for two records and a half
+	spool = &archiveSpool{dir: dir, maxSize: size*2 + size/2, sizes: make(map[string]int64)}
+	if err := spool.scan(); err != nil {
+		t.Fatal(err)
+	}
+	if len(spool.files) != 1 || spool.total != size {
+		t.Fatalf("scan found %v of %d bytes", spool.files, spool.total)
+	}
+	for i := 1; i < 5; i++ {
+		write(spool, i)
+	}
+
+	names := files()
+	if len(names) != 2 || spool.total > spool.maxSize {
+		t.Fatalf("spool has %v of %d bytes, limit %d", names, spool.total, spool.maxSize)
+	}
+	for i, name := range names {
+		if want := fmt.Sprintf("%020d", start.Add(time.Duration(3+i)*time.Second).UnixNano()); !strings.HasPrefix(filepath.Base(name), want) {
+			t.Errorf("kept %s, want record %s", filepath.Base(name), want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/TykTechnologies/go-plugins-template/identity"
+)
+
+const (
+	// First authenticator which recognizes credentials decides
+	AuthModeAny = "any"
+	// All authenticators should succeed, identity comes from the first one
+	AuthModeAll = "all"
+)
+
+// Authenticators implementing it add WWW-Authenticate challenge to 401 responses
+type challenger interface {
+	Challenge() string
+}
+
+type basicAuthenticator struct {
+	login    string
+	password *Secret
+}
+
+func (a basicAuthenticator) Authenticate(r *http.Request) (identity.Identity, error) {
+	login, password, ok := r.BasicAuth()
+	if !ok {
+		return identity.Identity{}, identity.ErrNoCredentials
+	}
+
+	loginMatch := subtle.ConstantTimeCompare([]byte(login), []byte(a.login)) == 1
+	// Evaluated even if login does not match, so timing does not tell which one is wrong
+	passwordMatch := a.password.Matches(password)
+	if !loginMatch || !passwordMatch {
+		return identity.Identity{}, errors.New("invalid credentials")
+	}
+
+	return identity.Identity{Subject: login, Method: "basic"}, nil
+}
+
+func (a basicAuthenticator) Challenge() string {
+	return `Basic realm="proxy"`
+}
+
+func authenticate(r *http.Request, mode string, authenticators []identity.Authenticator) (identity.Identity, error) {
+	var primary identity.Identity
+	err := identity.ErrNoCredentials
+
+	for i, authenticator := range authenticators {
+		id, authErr := authenticator.Authenticate(r)
+		if mode == AuthModeAll {
+			if authErr != nil {
+				return identity.Identity{}, authErr
+			}
+			if i == 0 {
+				primary = id
+			}
+			continue
+		}
+
+		if authErr == nil {
+			return id, nil
+		}
+		// Keep the most meaningful error, e.g. invalid credentials over missing ones
+		if authErr != identity.ErrNoCredentials {
+			err = authErr
+		}
+	}
+
+	if mode == AuthModeAll {
+		return primary, nil
+	}
+	return identity.Identity{}, err
+}
+
+// Authenticates requests with given authenticators, combined according to mode,
+// and stores resulting identity in request context. Nil authenticators are skipped. Only looks at headers and never
+// reads the body, so clients sending `Expect: 100-continue` are rejected before
+// they upload anything.
+func Authenticate(mode string, authenticators ...identity.Authenticator) Middleware {
+	var enabled []identity.Authenticator
+	for _, authenticator := range authenticators {
+		if authenticator != nil {
+			enabled = append(enabled, authenticator)
+		}
+	}
+	if len(enabled) == 0 {
+		return nil
+	}
+	authenticators = enabled
+
+	if mode != AuthModeAny && mode != AuthModeAll {
+		log.Fatal("Auth mode should be 'any' or 'all' ", mode)
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, err := authenticate(r, mode, authenticators)
+			if err != nil {
+				recordDecision(r, "auth", decisionDeny, err.Error())
+				denyForwardAuth(r)
+				for _, authenticator := range authenticators {
+					if c, ok := authenticator.(challenger); ok {
+						w.Header().Add("WWW-Authenticate", c.Challenge())
+					}
+				}
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			setUsageIdentity(r, id.Subject)
+			setAccessLogIdentity(r, id.Subject, id.Method)
+			recordDecision(r, "auth", decisionAllow, id.Method+" user "+id.Subject)
+
+			ctx := identity.NewContext(r.Context(), id)
+			// Kept for plugins which read plain username
+			ctx = context.WithValue(ctx, "Username", id.Subject)
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func BasicAuth(login string, password *Secret) Middleware {
+	return Authenticate(AuthModeAny, BasicAuthenticator(login, password))
+}
+
+// Returns basic auth authenticator, or nil if login or password is empty.
+// Rotated password is picked up without restart.
+func BasicAuthenticator(login string, password *Secret) identity.Authenticator {
+	if login == "" || password == nil {
+		return nil
+	}
+	return basicAuthenticator{login, password}
+}
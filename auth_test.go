@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/TykTechnologies/go-plugins-template/identity"
+)
+
+// Authenticator returning fixed result, with optional challenge
+type fakeAuthenticator struct {
+	id        identity.Identity
+	err       error
+	challenge string
+}
+
+func (a fakeAuthenticator) Authenticate(r *http.Request) (identity.Identity, error) {
+	return a.id, a.err
+}
+
+type challengingAuthenticator struct {
+	fakeAuthenticator
+}
+
+func (a challengingAuthenticator) Challenge() string {
+	return a.challenge
+}
+
+func TestAuthenticate(t *testing.T) {
+	alice := fakeAuthenticator{id: identity.Identity{Subject: "alice", Method: "first"}}
+	bob := fakeAuthenticator{id: identity.Identity{Subject: "bob", Method: "second"}}
+	missing := fakeAuthenticator{err: identity.ErrNoCredentials}
+	invalid := fakeAuthenticator{err: errors.New("invalid credentials")}
+
+	tests := []struct {
+		name           string
+		mode           string
+		authenticators []identity.Authenticator
+		want           string
+		err            error
+	}{
+		{"any first match wins", AuthModeAny, []identity.Authenticator{alice, bob}, "alice", nil},
+		{"any skips missing credentials", AuthModeAny, []identity.Authenticator{missing, bob}, "bob", nil},
+		{"any prefers invalid over missing", AuthModeAny, []identity.Authenticator{invalid, missing}, "", invalid.err},
+		{"any prefers invalid over later missing", AuthModeAny, []identity.Authenticator{missing, invalid, missing}, "", invalid.err},
+		{"any without credentials", AuthModeAny, []identity.Authenticator{missing, missing}, "", identity.ErrNoCredentials},
+		{"all returns first identity", AuthModeAll, []identity.Authenticator{alice, bob}, "alice", nil},
+		{"all fails on missing", AuthModeAll, []identity.Authenticator{alice, missing}, "", identity.ErrNoCredentials},
+		{"all fails on invalid", AuthModeAll, []identity.Authenticator{invalid, bob}, "", invalid.err},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := authenticate(httptest.NewRequest("GET", "/", nil), tt.mode, tt.authenticators)
+			if err != tt.err {
+				t.Errorf("error %v, want %v", err, tt.err)
+			}
+			if id.Subject != tt.want {
+				t.Errorf("subject %q, want %q", id.Subject, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateMiddleware(t *testing.T) {
+	alice := fakeAuthenticator{id: identity.Identity{Subject: "alice", Method: "fake"}}
+	denied := challengingAuthenticator{fakeAuthenticator{err: identity.ErrNoCredentials, challenge: `Fake realm="proxy"`}}
+
+	var seen identity.Identity
+	var username interface{}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = identity.FromContext(r.Context())
+		username = r.Context().Value("Username")
+	})
+
+	w := httptest.NewRecorder()
+	Chain(ok, Authenticate(AuthModeAny, denied, alice)).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || !reflect.DeepEqual(seen, alice.id) || username != "alice" {
+		t.Errorf("status %d, identity %+v, username %v", w.Code, seen, username)
+	}
+
+	w = httptest.NewRecorder()
+	Chain(ok, Authenticate(AuthModeAll, alice, denied, nil)).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, want 401", w.Code)
+	}
+	if got := w.Header().Values("WWW-Authenticate"); !reflect.DeepEqual(got, []string{denied.challenge}) {
+		t.Errorf("WWW-Authenticate %v", got)
+	}
+
+	if Authenticate(AuthModeAny, nil, nil) != nil {
+		t.Error("middleware without authenticators should be disabled")
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Rejects request bodies larger than limit. Declared Content-Length is checked before
+// anything reads the body, so clients sending `Expect: 100-continue` get 413 instead
+// of `100 Continue` and never stream the payload. Bodies of unknown length are cut at limit.
+// Should run first in the chain, before any middleware which can read the body.
+func MaxBodySize(limit int64) Middleware {
+	if limit <= 0 {
+		return nil
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				log.Println("Request body too large", r.URL.Path, r.ContentLength)
+				recordDecision(r, "max-body-size", decisionDeny, fmt.Sprintf("content length %d exceeds %d bytes", r.ContentLength, limit))
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			h.ServeHTTP(w, r)
+		})
+	}
+}
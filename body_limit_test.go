@@ -0,0 +1,100 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Counts bytes client uploaded
+type uploadBody struct {
+	io.Reader
+	read *int64
+}
+
+func (b uploadBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	atomic.AddInt64(b.read, int64(n))
+	return n, err
+}
+
+// Clients waiting for 100 Continue are rejected before they upload anything,
+// and get upstream's continue decision when the request proceeds
+func TestExpectContinue(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/refuse" {
+			// Answered before reading the body, so no 100 Continue is sent
+			http.Error(w, "Refused", http.StatusForbidden)
+			return
+		}
+		io.Copy(w, r.Body)
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = &http.Transport{ExpectContinueTimeout: 10 * time.Second}
+	server := httptest.NewServer(Chain(proxy,
+		DecisionTrail(),
+		MaxBodySize(1024),
+		BasicAuth("user", LoadSecret("continue-test", "pass")),
+	))
+	defer server.Close()
+
+	// Waits for interim response much longer than the test takes
+	client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: 10 * time.Second}}
+
+	tests := []struct {
+		name     string
+		path     string
+		size     int
+		password string
+		status   int
+		uploaded bool
+	}{
+		{"no credentials", "/", 100, "", http.StatusUnauthorized, false},
+		{"wrong credentials", "/", 100, "wrong", http.StatusUnauthorized, false},
+		{"too large", "/", 2048, "pass", http.StatusRequestEntityTooLarge, false},
+		{"upstream refuses", "/refuse", 100, "pass", http.StatusForbidden, false},
+		{"accepted", "/", 100, "pass", http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var read int64
+			payload := strings.Repeat("x", tt.size)
+			req, _ := http.NewRequest("POST", server.URL+tt.path, uploadBody{strings.NewReader(payload), &read})
+			req.ContentLength = int64(tt.size)
+			req.Header.Set("Expect", "100-continue")
+			if tt.password != "" {
+				req.SetBasicAuth("user", tt.password)
+			}
+
+			start := time.Now()
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if uploaded := atomic.LoadInt64(&read) > 0; uploaded != tt.uploaded {
+				t.Errorf("uploaded %d bytes, want upload %v", read, tt.uploaded)
+			}
+			if tt.uploaded && string(body) != payload {
+				t.Errorf("echoed %d bytes, want %d", len(body), len(payload))
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Errorf("client waited for the continue timeout")
+			}
+		})
+	}
+}
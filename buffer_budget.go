@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Buffers grown above this size are dropped instead of pooled, so one large body
+// does not pin memory forever
+const maxPooledBufferSize = 1 << 20
+
+var (
+	bufferBudgetUsed      = expvar.NewInt("buffer_budget_used")
+	bufferBudgetExhausted = expvar.NewInt("buffer_budget_exhausted")
+)
+
+// Limits total size of bodies buffered at once by all features, like JSON redaction.
+// Each feature also caps its own buffers, and when budget is exhausted it falls back
+// to its behavior for bodies above that cap.
+type bufferBudget struct {
+	limit int64
+	used  int64
+	// Exported as counters
+	usedMetric      *expvar.Int
+	exhaustedMetric *expvar.Int
+}
+
+// Shared by all buffering features, limit is set by -buffer-budget
+var buffers = &bufferBudget{usedMetric: bufferBudgetUsed, exhaustedMetric: bufferBudgetExhausted}
+
+// Reserves n bytes, returns false if they do not fit. Zero limit means unlimited.
+func (b *bufferBudget) reserve(n int64) bool {
+	for {
+		used := atomic.LoadInt64(&b.used)
+		if b.limit > 0 && used+n > b.limit {
+			b.exhaustedMetric.Add(1)
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.used, used, used+n) {
+			b.usedMetric.Add(n)
+			return true
+		}
+	}
+}
+
+func (b *bufferBudget) release(n int64) {
+	atomic.AddInt64(&b.used, -n)
+	b.usedMetric.Add(-n)
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// Body read from pooled buffers. On Close, buffers go back to the pool and
+// reservation back to the budget, as nothing reads them anymore.
+type pooledBody struct {
+	io.Reader
+	upstream io.Closer
+	buffers  []*bytes.Buffer
+	reserved int64
+	once     sync.Once
+}
+
+// Reserves n more bytes for buffers of the body, released together on Close
+func (b *pooledBody) reserve(n int64) bool {
+	if !buffers.reserve(n) {
+		return false
+	}
+	b.reserved += n
+	return true
+}
+
+func (b *pooledBody) Close() error {
+	b.once.Do(func() {
+		for _, buf := range b.buffers {
+			putBuffer(buf)
+		}
+		buffers.release(b.reserved)
+	})
+	return b.upstream.Close()
+}
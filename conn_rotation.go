@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"expvar"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/http/httputil"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	upstreamConnsOpened  = expvar.NewInt("upstream_conns_opened")
+	upstreamConnsRotated = expvar.NewInt("upstream_conns_rotated")
+	upstreamConnAge      = newHistogram("upstream_conn_age",
+		time.Second, 10*time.Second, time.Minute, 10*time.Minute, time.Hour)
+	// Number of requests served by each connection, by power of 10 upper bound
+	upstreamConnRequests = expvar.NewMap("upstream_conn_requests")
+)
+
+// Upstream connection which knows its age and how many requests it served
+type trackedConn struct {
+	net.Conn
+	created   time.Time
+	lifetime  time.Duration
+	requests  int64
+	closeOnce sync.Once
+	// Set once connection expired, it is closed when its response body is
+	closeAfterUse int32
+}
+
+func (c *trackedConn) expired(maxRequests int64) bool {
+	requests := atomic.AddInt64(&c.requests, 1)
+	return time.Since(c.created) >= c.lifetime || (maxRequests > 0 && requests >= maxRequests)
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() {
+		upstreamConnAge.Observe(time.Since(c.created))
+
+		bucket := int64(1)
+		for bucket < atomic.LoadInt64(&c.requests) {
+			bucket *= 10
+		}
+		upstreamConnRequests.Add(strconv.FormatInt(bucket, 10), 1)
+	})
+	return c.Conn.Close()
+}
+
+func trackedConnOf(conn net.Conn) *trackedConn {
+	switch c := conn.(type) {
+	case *trackedConn:
+		return c
+	case *tls.Conn:
+		tracked, _ := c.NetConn().(*trackedConn)
+		return tracked
+	}
+	return nil
+}
+
+// Closes connection once it gets too old or served too many requests, after the response
+// body is closed. Closing the connection itself also works when transport copies request,
+// e.g. to rewind its body, which asking to close with Request.Close does not.
+// Works for HTTP/1.1 connections, HTTP/2 ones are shared by requests and left as is.
+type rotatingTransport struct {
+	next        http.RoundTripper
+	maxRequests int64
+}
+
+// Closes expired connection along with response body
+type rotatingBody struct {
+	io.ReadCloser
+	conn *trackedConn
+}
+
+func (b rotatingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.conn.rotate()
+	return err
+}
+
+func (c *trackedConn) rotate() {
+	if atomic.CompareAndSwapInt32(&c.closeAfterUse, 1, 2) {
+		upstreamConnsRotated.Add(1)
+		c.Close()
+	}
+}
+
+func (t *rotatingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	var outreq *http.Request
+	var conn *trackedConn
+
+	// Called again for the new connection if transport retries request
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if tls, ok := info.Conn.(*tls.Conn); ok && tls.ConnectionState().NegotiatedProtocol == "h2" {
+				conn = nil
+				return
+			}
+			conn = trackedConnOf(info.Conn)
+			if conn != nil && conn.expired(t.maxRequests) {
+				atomic.CompareAndSwapInt32(&conn.closeAfterUse, 0, 1)
+				// Keeps connection out of idle pool, unless transport copied the request
+				outreq.Close = true
+			}
+		},
+	}
+	outreq = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+
+	resp, err := t.next.RoundTrip(outreq)
+	if conn == nil || atomic.LoadInt32(&conn.closeAfterUse) != 1 {
+		return resp, err
+	}
+	if err != nil {
+		conn.rotate()
+		return resp, err
+	}
+	resp.Body = rotatingBody{resp.Body, conn}
+	return resp, nil
+}
+
+// Closes upstream connections after maxLifetime, or once they served maxRequests requests,
+// so long-lived keep-alive connections do not pin proxy to the same backends behind
+// L4 load balancer. Lifetime of each connection is randomly cut by up to 20%,
+// so connections opened together do not expire at the same time.
+func UpstreamConnRotation(maxLifetime time.Duration, maxRequests int) ProxyOption {
+	if maxLifetime <= 0 && maxRequests <= 0 {
+		return nil
+	}
+	if maxLifetime <= 0 {
+		maxLifetime = time.Duration(1<<63 - 1)
+	}
+
+	return func(proxy *httputil.ReverseProxy) {
+		if proxy.Transport == nil {
+			proxy.Transport = http.DefaultTransport
+		}
+		transport, ok := proxy.Transport.(*http.Transport)
+		if !ok {
+			log.Println("Upstream connection rotation requires *http.Transport, ignoring", reflect.TypeOf(proxy.Transport))
+			return
+		}
+
+		transport = transport.Clone()
+		dial := transport.DialContext
+		if dial == nil {
+			dial = (&net.Dialer{}).DialContext
+		}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			upstreamConnsOpened.Add(1)
+			lifetime := maxLifetime - time.Duration(rand.Int63n(int64(maxLifetime/5)+1))
+			return &trackedConn{Conn: conn, created: time.Now(), lifetime: lifetime}, nil
+		}
+
+		proxy.Transport = &rotatingTransport{next: transport, maxRequests: int64(maxRequests)}
+	}
+}
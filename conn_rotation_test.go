@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUpstreamConnRotation(t *testing.T) {
+	var mu sync.Mutex
+	conns := map[string]bool{}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, "ok")
+	}))
+	upstream.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			conns[c.RemoteAddr().String()] = true
+			mu.Unlock()
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = &http.Transport{}
+	h := ApplyProxyOptions(proxy, UpstreamConnRotation(0, 2))
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+	}{
+		{"GET", "GET", ""},
+		// Transport copies requests with body, so asking to close them is not enough
+		{"POST", "POST", "payload"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			conns = map[string]bool{}
+			mu.Unlock()
+			proxy.Transport.(*rotatingTransport).next.(*http.Transport).CloseIdleConnections()
+			rotated := upstreamConnsRotated.Value()
+
+			for i := 0; i < 6; i++ {
+				var body io.Reader
+				if tt.body != "" {
+					body = strings.NewReader(tt.body)
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest(tt.method, "/", body))
+				if w.Code != http.StatusOK {
+					t.Fatalf("request %d: status %d", i, w.Code)
+				}
+			}
+
+			mu.Lock()
+			opened := len(conns)
+			mu.Unlock()
+			if opened != 3 {
+				t.Errorf("6 requests used %d connections, want 3", opened)
+			}
+			if got := upstreamConnsRotated.Value() - rotated; got != 3 {
+				t.Errorf("upstream_conns_rotated grew by %d, want 3", got)
+			}
+		})
+	}
+}
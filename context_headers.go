@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/TykTechnologies/go-plugins-template/identity"
+)
+
+// Context values with well-known meaning. Any other key is read
+// as a plain string context value, e.g. one set by a plugin.
+var wellKnownContextValues = map[string]func(ctx context.Context) string{
+	"identity": func(ctx context.Context) string {
+		id, _ := identity.FromContext(ctx)
+		return id.Subject
+	},
+	"auth-method": func(ctx context.Context) string {
+		id, _ := identity.FromContext(ctx)
+		return id.Method
+	},
+}
+
+type contextHeader struct {
+	key          string
+	header       string
+	stripInbound bool
+	value        func(ctx context.Context) string
+}
+
+// Parses comma separated list of `<context key>:<header>[:keep]` entries.
+// Unless `keep` is set, header sent by client is removed when context value is absent,
+// so clients can't spoof it.
+func parseContextHeaders(spec string) ([]contextHeader, error) {
+	var mappings []contextHeader
+	for _, item := range splitList(spec) {
+		bits := strings.Split(item, ":")
+		if len(bits) < 2 || len(bits) > 3 || bits[0] == "" || bits[1] == "" || (len(bits) == 3 && bits[2] != "keep") {
+			return nil, fmt.Errorf("Entry '%s' should have '<context key>:<header>[:keep]' format", item)
+		}
+
+		key := bits[0]
+		value, ok := wellKnownContextValues[key]
+		if !ok {
+			value = func(ctx context.Context) string {
+				str, _ := ctx.Value(key).(string)
+				return str
+			}
+		}
+
+		mappings = append(mappings, contextHeader{
+			key:          key,
+			header:       http.CanonicalHeaderKey(bits[1]),
+			stripInbound: len(bits) == 2,
+			value:        value,
+		})
+	}
+	return mappings, nil
+}
+
+// Sends request context values to upstream as headers, e.g. `identity:X-User`.
+// Generalizes what the POST plugin example does for Username.
+func ContextHeaders(spec string) ProxyOption {
+	mappings, err := parseContextHeaders(spec)
+	if err != nil {
+		log.Fatal("Can't parse context headers ", err)
+	}
+	if len(mappings) == 0 {
+		return nil
+	}
+
+	return func(proxy *httputil.ReverseProxy) {
+		director := proxy.Director
+		if director == nil {
+			log.Println("Context headers require proxy with Director, ignoring")
+			return
+		}
+
+		proxy.Director = func(r *http.Request) {
+			director(r)
+
+			for _, m := range mappings {
+				if value := m.value(r.Context()); value != "" {
+					r.Header.Set(m.header, sanitizeValue(value))
+				} else if m.stripInbound {
+					r.Header.Del(m.header)
+				}
+			}
+		}
+	}
+}
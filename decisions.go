@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/TykTechnologies/go-plugins-template/trail"
+)
+
+const (
+	decisionAllow = trail.Allow
+	decisionDeny  = trail.Deny
+)
+
+func recordDecision(r *http.Request, middleware, decision, detail string) {
+	trail.FromContext(r.Context()).Append(trail.Entry{Middleware: middleware, Decision: decision, Detail: detail})
+}
+
+// Starts decision trail of the request, read by debug headers, access log and plugins,
+// together with the rest of request state. Should be first in the chain, so every
+// middleware can record its decisions.
+func DecisionTrail() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, r.WithContext(&requestState{Context: r.Context()}))
+		})
+	}
+}
+
+// Adds trail to response headers right before they are sent
+type debugHeadersWriter struct {
+	http.ResponseWriter
+	trail       *trail.Trail
+	wroteHeader bool
+}
+
+func (w *debugHeadersWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= 200 {
+		w.wroteHeader = true
+
+		// Details can contain client supplied values, like user name
+		for _, e := range w.trail.Entries() {
+			w.Header().Add("X-Debug-Decision", sanitizeValue(e.String()))
+			if e.Decision == decisionDeny && code >= 400 {
+				w.Header().Set("X-Debug-Rejected-By", sanitizeValue(e.Middleware))
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *debugHeadersWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *debugHeadersWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+var debugHeadersWriters = sync.Pool{
+	New: func() interface{} {
+		return &debugHeadersWriter{}
+	},
+}
+
+// Explains decisions made by middlewares, like which one rejected the request and why,
+// in `X-Debug-Decision` and `X-Debug-Rejected-By` response headers.
+// If secret is set, only requests with matching `X-Debug-Secret` header get them.
+// Should be placed right after DecisionTrail, to see decisions of all other middlewares.
+func DebugHeaders(enabled bool, secret *Secret) Middleware {
+	if !enabled {
+		return nil
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestSecret := r.Header.Get("X-Debug-Secret")
+			r.Header.Del("X-Debug-Secret")
+			if secret != nil && !secret.Matches(requestSecret) {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			dw := debugHeadersWriters.Get().(*debugHeadersWriter)
+			*dw = debugHeadersWriter{ResponseWriter: w, trail: trail.FromContext(r.Context())}
+			defer func() {
+				*dw = debugHeadersWriter{}
+				debugHeadersWriters.Put(dw)
+			}()
+			h.ServeHTTP(dw, r)
+		})
+	}
+}
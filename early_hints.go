@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Drops informational responses, which HTTP/1.0 clients do not understand
+type interimResponseGuard struct {
+	http.ResponseWriter
+}
+
+func (w interimResponseGuard) WriteHeader(code int) {
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Allows http.ResponseController to reach Flush and Hijack of original writer
+func (w interimResponseGuard) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Sends `103 Early Hints` with given Link header value before request reaches upstream,
+// even if upstream does not send them itself. Hints sent by upstream are forwarded by the proxy.
+// Neither of them is sent to HTTP/1.0 clients.
+func EarlyHints(links string) Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !r.ProtoAtLeast(1, 1) {
+				h.ServeHTTP(interimResponseGuard{w}, r)
+				return
+			}
+
+			if links != "" {
+				w.Header().Set("Link", links)
+				w.WriteHeader(http.StatusEarlyHints)
+				// Header map is not reset after interim response, final one gets upstream Link only
+				w.Header().Del("Link")
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
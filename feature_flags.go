@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/TykTechnologies/go-plugins-template/flags"
+)
+
+const featureFlagsAdminPath = "/__proxy/flags"
+
+var featureFlagChanges = expvar.NewMap("feature_flag_changes")
+
+// Defines flags from comma separated list of `<name>=<type>:<default>` entries,
+// e.g. `new-ui=bool:false,beta=percentage:20,theme=string:dark`
+func FeatureFlags(spec string) {
+	for _, item := range splitList(spec) {
+		name, definition, _ := strings.Cut(item, "=")
+		typ, value, found := strings.Cut(definition, ":")
+		if name == "" || !found {
+			log.Fatal("Feature flag should have '<name>=<type>:<default>' format ", item)
+		}
+		if err := flags.Define(name, typ, value); err != nil {
+			log.Fatal("Can't define feature flag ", err)
+		}
+	}
+}
+
+// Lists flags on GET /__proxy/flags, and changes flag value on PUT /__proxy/flags/<name>,
+// with new value as request body. Changes are logged as audit records.
+func featureFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, featureFlagsAdminPath), "/")
+	if name == "" {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(flags.All())
+		return
+	}
+
+	if !allowMethods(w, r, http.MethodPut) {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 4096))
+	if err != nil {
+		http.Error(w, "Can't read flag value", http.StatusBadRequest)
+		return
+	}
+	value := strings.TrimSpace(string(body))
+
+	previous, err := flags.Set(name, value)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	featureFlagChanges.Add(name, 1)
+	log.Printf("Feature flag %s changed from %q to %q by %s", name, previous, value, r.RemoteAddr)
+	fmt.Fprintln(w, value)
+}
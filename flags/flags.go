@@ -0,0 +1,155 @@
+// Package flags is the feature flag store of the proxy. Flags are defined by the proxy
+// configuration and toggled at runtime through admin API, and plugins import it
+// to read them. Every evaluation is recorded in request decision trail.
+package flags
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/TykTechnologies/go-plugins-template/identity"
+	"github.com/TykTechnologies/go-plugins-template/trail"
+)
+
+const (
+	TypeBool       = "bool"
+	TypeString     = "string"
+	TypePercentage = "percentage"
+)
+
+type Flag struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+var store struct {
+	sync.RWMutex
+	flags map[string]Flag
+}
+
+func validate(typ, value string) error {
+	switch typ {
+	case TypeBool:
+		_, err := strconv.ParseBool(value)
+		return err
+	case TypeString:
+		return nil
+	case TypePercentage:
+		if n, err := strconv.Atoi(value); err != nil || n < 0 || n > 100 {
+			return fmt.Errorf("percentage should be a number from 0 to 100 '%s'", value)
+		}
+		return nil
+	}
+	return fmt.Errorf("flag type should be 'bool', 'string' or 'percentage' '%s'", typ)
+}
+
+// Adds flag with its default value
+func Define(name, typ, value string) error {
+	if err := validate(typ, value); err != nil {
+		return fmt.Errorf("flag %s: %w", name, err)
+	}
+
+	store.Lock()
+	defer store.Unlock()
+	if store.flags == nil {
+		store.flags = make(map[string]Flag)
+	}
+	store.flags[name] = Flag{name, typ, value}
+	return nil
+}
+
+// Changes value of defined flag, returns the previous one
+func Set(name, value string) (string, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	flag, ok := store.flags[name]
+	if !ok {
+		return "", fmt.Errorf("flag %s is not defined", name)
+	}
+	if err := validate(flag.Type, value); err != nil {
+		return "", fmt.Errorf("flag %s: %w", name, err)
+	}
+	previous := flag.Value
+	flag.Value = value
+	store.flags[name] = flag
+	return previous, nil
+}
+
+// All flags, sorted by name
+func All() []Flag {
+	store.RLock()
+	defer store.RUnlock()
+
+	all := make([]Flag, 0, len(store.flags))
+	for _, flag := range store.flags {
+		all = append(all, flag)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+func lookup(r *http.Request, name, typ string) (string, bool) {
+	store.RLock()
+	flag, ok := store.flags[name]
+	store.RUnlock()
+
+	if !ok || flag.Type != typ {
+		trail.FromContext(r.Context()).Append(trail.Entry{Middleware: "flags", Decision: "undefined", Detail: name})
+		return "", false
+	}
+	return flag.Value, true
+}
+
+func record(r *http.Request, name, result string) {
+	trail.FromContext(r.Context()).Append(trail.Entry{Middleware: "flags", Decision: "evaluate", Detail: name + "=" + result})
+}
+
+// Value of bool flag, false if it is not defined
+func Bool(r *http.Request, name string) bool {
+	value, ok := lookup(r, name, TypeBool)
+	enabled, _ := strconv.ParseBool(value)
+	if ok {
+		record(r, name, strconv.FormatBool(enabled))
+	}
+	return enabled
+}
+
+// Value of string flag, empty if it is not defined
+func String(r *http.Request, name string) string {
+	value, ok := lookup(r, name, TypeString)
+	if ok {
+		record(r, name, value)
+	}
+	return value
+}
+
+// Reports whether request falls into percentage rollout. Sticky: the same client,
+// authenticated identity or else client IP, always gets the same result for given percentage.
+func Rollout(r *http.Request, name string) bool {
+	value, ok := lookup(r, name, TypePercentage)
+	if !ok {
+		return false
+	}
+	percentage, _ := strconv.Atoi(value)
+
+	key := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(key); err == nil {
+		key = host
+	}
+	if id, ok := identity.FromContext(r.Context()); ok && id.Subject != "" {
+		key = id.Subject
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(name + "\x00" + key))
+	enabled := int(h.Sum32()%100) < percentage
+	record(r, name, strconv.FormatBool(enabled))
+	return enabled
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const forwardDialTimeout = 10 * time.Second
+
+type forwardContextKey struct{}
+
+// Origin requested by forward proxy client, already checked against allowed ones
+type forwardRequest struct {
+	origin *url.URL
+	// Credentials came in Proxy-Authorization, and should not reach upstream
+	proxyAuth bool
+	// Authorization client sent for the origin itself, restored before proxying
+	authorization []string
+	// Set by auth middleware, so only its 401 responses are translated to 407
+	authDenied bool
+}
+
+// Marks forward proxy request as denied by proxy auth, rather than by the origin
+func denyForwardAuth(r *http.Request) {
+	if forward, ok := r.Context().Value(forwardContextKey{}).(*forwardRequest); ok {
+		forward.authDenied = true
+	}
+}
+
+// Returns `host:port`, using default port of the scheme if host has none
+func originAddress(scheme, host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	port := "80"
+	if scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// Returns `scheme://host:port`, so equal origins compare equal
+func canonicalOrigin(scheme, host string) string {
+	scheme = strings.ToLower(scheme)
+	return scheme + "://" + originAddress(scheme, strings.ToLower(host))
+}
+
+// Translates 401 responses of proxy auth to 407, which forward proxy clients expect.
+// 401 responses of the origin are passed as is.
+type proxyAuthWriter struct {
+	http.ResponseWriter
+	forward *forwardRequest
+}
+
+func (w proxyAuthWriter) WriteHeader(code int) {
+	if code == http.StatusUnauthorized && w.forward.authDenied {
+		header := w.Header()
+		header["Proxy-Authenticate"] = header["Www-Authenticate"]
+		header.Del("WWW-Authenticate")
+		code = http.StatusProxyAuthRequired
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w proxyAuthWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Accepts only absolute-form requests, like `GET http://host/path`, and CONNECT requests,
+// to the target origin or one of comma separated allowed origins, e.g. `https://api.example.com`.
+// CONNECT is allowed for https origins only. Credentials sent in Proxy-Authorization are
+// passed to authenticators as Authorization, and their 401 responses are sent as 407 with
+// Proxy-Authenticate challenge. Authorization sent for the origin still reaches it.
+// Should be placed before auth, so everything else in the chain works as in reverse mode.
+func ForwardOrigins(enabled bool, upstream *ProxyTarget, allow string) Middleware {
+	if !enabled {
+		return nil
+	}
+
+	// Target origin follows config swaps, so it is checked for every request
+	allowed := map[string]*url.URL{}
+	for _, item := range splitList(allow) {
+		origin, err := url.Parse(item)
+		if err != nil || origin.Host == "" || (origin.Scheme != "http" && origin.Scheme != "https") {
+			log.Fatal("Forward origin should have 'http(s)://host[:port]' format ", item)
+		}
+		allowed[canonicalOrigin(origin.Scheme, origin.Host)] = origin
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var requested string
+			switch {
+			case r.Method == http.MethodConnect:
+				requested = canonicalOrigin("https", r.Host)
+			case r.URL.IsAbs():
+				requested = canonicalOrigin(r.URL.Scheme, r.URL.Host)
+			default:
+				recordDecision(r, "forward-mode", decisionDeny, "request URI is not absolute")
+				http.Error(w, "Forward proxy requires absolute request URI", http.StatusBadRequest)
+				return
+			}
+
+			origin, ok := allowed[requested]
+			if target := upstream.Load().Target; requested == canonicalOrigin(target.Scheme, target.Host) {
+				origin, ok = target, true
+			}
+			if !ok {
+				recordDecision(r, "forward-mode", decisionDeny, "origin "+requested+" is not allowed")
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			recordDecision(r, "forward-mode", decisionAllow, "origin "+requested)
+
+			forward := &forwardRequest{origin: origin}
+			if credentials := r.Header.Get("Proxy-Authorization"); credentials != "" {
+				forward.proxyAuth = true
+				forward.authorization = r.Header.Values("Authorization")
+				r.Header.Set("Authorization", credentials)
+				r.Header.Del("Proxy-Authorization")
+			}
+
+			h.ServeHTTP(proxyAuthWriter{w, forward}, r.WithContext(context.WithValue(r.Context(), forwardContextKey{}, forward)))
+		})
+	}
+}
+
+// Sends forward proxy requests to the origin client asked for, instead of the target
+func ForwardRouting(enabled bool) ProxyOption {
+	if !enabled {
+		return nil
+	}
+
+	return func(proxy *httputil.ReverseProxy) {
+		director := proxy.Director
+		if director == nil {
+			log.Println("Forward mode requires proxy with Director, ignoring")
+			return
+		}
+
+		proxy.Director = func(r *http.Request) {
+			director(r)
+
+			forward, ok := r.Context().Value(forwardContextKey{}).(*forwardRequest)
+			if !ok {
+				return
+			}
+			r.URL.Scheme = forward.origin.Scheme
+			r.URL.Host = forward.origin.Host
+			r.Host = forward.origin.Host
+			if forward.proxyAuth {
+				r.Header.Del("Authorization")
+				if len(forward.authorization) > 0 {
+					r.Header["Authorization"] = forward.authorization
+				}
+			}
+		}
+	}
+}
+
+// Tunnels bytes of CONNECT requests approved by the chain. Should be last in the chain.
+func ForwardTunnel(enabled bool) Middleware {
+	if !enabled {
+		return nil
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			forward, ok := r.Context().Value(forwardContextKey{}).(*forwardRequest)
+			if r.Method != http.MethodConnect || !ok {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			dialer := net.Dialer{Timeout: forwardDialTimeout}
+			upstream, err := dialer.DialContext(r.Context(), "tcp", originAddress("https", forward.origin.Host))
+			if err != nil {
+				log.Println("Can't connect to forward origin", forward.origin.Host, err)
+				http.Error(w, "Bad Gateway", http.StatusBadGateway)
+				return
+			}
+			defer upstream.Close()
+
+			conn, buffered, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				log.Println("Can't tunnel CONNECT request", r.Proto, err)
+				http.Error(w, "CONNECT requires HTTP/1.1", http.StatusHTTPVersionNotSupported)
+				return
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+				return
+			}
+
+			done := make(chan struct{})
+			go func() {
+				// Buffered reader holds bytes client sent right after CONNECT
+				io.Copy(upstream, buffered)
+				if tcp, ok := upstream.(*net.TCPConn); ok {
+					tcp.CloseWrite()
+				}
+				close(done)
+			}()
+			io.Copy(conn, upstream)
+			conn.Close()
+			<-done
+		})
+	}
+}
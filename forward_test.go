@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+func TestForwardProxyAuth(t *testing.T) {
+	// Origin with its own auth
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer origin" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="origin"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer origin.Close()
+
+	target, _ := url.Parse(origin.URL)
+	h := Chain(
+		ApplyProxyOptions(httputil.NewSingleHostReverseProxy(target), ForwardRouting(true)),
+		DecisionTrail(),
+		ForwardOrigins(true, NewProxyTarget(NewProxyConfig(target, "")), ""),
+		BasicAuth("user", LoadSecret("forward-test", "pass")),
+	)
+
+	tests := []struct {
+		name          string
+		proxyAuth     string
+		authorization string
+		status        int
+		challenge     string
+	}{
+		{"no proxy credentials", "", "Bearer origin", http.StatusProxyAuthRequired, "Proxy-Authenticate"},
+		{"wrong proxy credentials", "Basic dXNlcjp3cm9uZw==", "Bearer origin", http.StatusProxyAuthRequired, "Proxy-Authenticate"},
+		{"origin credentials kept", "Basic dXNlcjpwYXNz", "Bearer origin", http.StatusOK, ""},
+		{"origin 401 passed as is", "Basic dXNlcjpwYXNz", "", http.StatusUnauthorized, "Www-Authenticate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", origin.URL+"/a", nil)
+			if tt.proxyAuth != "" {
+				r.Header.Set("Proxy-Authorization", tt.proxyAuth)
+			}
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.challenge != "" && w.Header().Get(tt.challenge) == "" {
+				t.Errorf("no %s challenge in %v", tt.challenge, w.Header())
+			}
+		})
+	}
+}
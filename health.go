@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	healthCheckTimeout  = 2 * time.Second
+	healthCheckCacheTTL = 5 * time.Second
+)
+
+// HealthChecker reports state of a runtime dependency, like upstream or a database.
+// Stateful middlewares register their dependencies with RegisterHealthChecker.
+type HealthChecker interface {
+	Name() string
+	Check(ctx context.Context) error
+}
+
+type HealthStatus struct {
+	Name      string        `json:"name"`
+	Healthy   bool          `json:"healthy"`
+	Blocking  bool          `json:"blocking"`
+	Latency   time.Duration `json:"latency_ns"`
+	LastError string        `json:"last_error,omitempty"`
+	CheckedAt time.Time     `json:"checked_at"`
+}
+
+type healthEntry struct {
+	checker HealthChecker
+
+	// Serializes checks, concurrent probes wait and reuse the fresh result
+	mu        sync.Mutex
+	status    HealthStatus
+	lastError string
+}
+
+var healthCheckers struct {
+	sync.Mutex
+	entries []*healthEntry
+}
+
+func RegisterHealthChecker(checker HealthChecker) {
+	healthCheckers.Lock()
+	defer healthCheckers.Unlock()
+	healthCheckers.entries = append(healthCheckers.entries, &healthEntry{checker: checker})
+}
+
+// Returns cached status, running the check again if cache expired
+func (e *healthEntry) check() HealthStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if time.Since(e.status.CheckedAt) < healthCheckCacheTTL {
+		return e.status
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := e.checker.Check(ctx)
+	e.status = HealthStatus{
+		Name:      e.checker.Name(),
+		Healthy:   err == nil,
+		Latency:   time.Since(start),
+		CheckedAt: start,
+	}
+	// Last error is kept after recovery, to help debugging flapping dependencies
+	if err != nil {
+		e.lastError = err.Error()
+	}
+	e.status.LastError = e.lastError
+
+	return e.status
+}
+
+// Aggregates lifecycle phase and all registered checks. Dependencies listed in informational
+// are reported, but do not make the proxy unready.
+func ReadyHandler(informational string) http.Handler {
+	nonBlocking := make(map[string]bool)
+	for _, name := range splitList(informational) {
+		nonBlocking[name] = true
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		healthCheckers.Lock()
+		entries := healthCheckers.entries
+		healthCheckers.Unlock()
+
+		statuses := make([]HealthStatus, len(entries))
+		var wg sync.WaitGroup
+		for i, entry := range entries {
+			wg.Add(1)
+			go func(i int, entry *healthEntry) {
+				defer wg.Done()
+				statuses[i] = entry.check()
+			}(i, entry)
+		}
+		wg.Wait()
+
+		// Not ready until startup completes, and again once draining starts
+		phase := lifecycle.Phase()
+		ready := phase == phaseReady
+		for i := range statuses {
+			statuses[i].Blocking = !nonBlocking[statuses[i].Name]
+			if statuses[i].Blocking && !statuses[i].Healthy {
+				ready = false
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ready":  ready,
+			"phase":  phase,
+			"checks": statuses,
+		})
+	})
+}
+
+// Checks that upstream accepts TCP connections
+type upstreamHealthChecker struct {
+	upstream *ProxyTarget
+}
+
+func (c upstreamHealthChecker) Name() string {
+	return "upstream"
+}
+
+func (c upstreamHealthChecker) Check(ctx context.Context) error {
+	target := c.upstream.Load().Target
+	host := target.Host
+	if target.Port() == "" {
+		port := "80"
+		if target.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(target.Hostname(), port)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
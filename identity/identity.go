@@ -0,0 +1,38 @@
+// Package identity defines authenticated identity shared by the proxy and its plugins.
+// Plugins import it to read the identity stored in request context by the auth chain.
+package identity
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Returned by authenticators when request carries no credentials they understand,
+// so the next authenticator can try
+var ErrNoCredentials = errors.New("no credentials found")
+
+// Identity of an authenticated client, produced the same way by every auth method
+type Identity struct {
+	Subject string
+	Method  string
+	Claims  map[string]interface{}
+	// Zero if identity does not expire
+	Expiry time.Time
+}
+
+type Authenticator interface {
+	Authenticate(r *http.Request) (Identity, error)
+}
+
+type contextKey struct{}
+
+func NewContext(ctx context.Context, id Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+func FromContext(ctx context.Context) (Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(Identity)
+	return id, ok
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+)
+
+const (
+	redactRemove = "remove"
+	redactMask   = "mask"
+	redactHash   = "hash"
+)
+
+type redactRule struct {
+	pointer []string
+	action  string
+	// HMAC key of hash action
+	key *Secret
+}
+
+// Parses comma separated list of `<json pointer>=<action>` rules, e.g.
+// `/ssn=remove,/card/number=mask`. Pointers follow RFC 6901. Hash action needs
+// hashKey, as plain hashes of short values, like SSNs, are reversed by trying them all.
+func parseRedactRules(spec string, hashKey *Secret) ([]redactRule, error) {
+	var rules []redactRule
+	for _, item := range splitList(spec) {
+		bits := strings.SplitN(item, "=", 2)
+		if len(bits) != 2 || !strings.HasPrefix(bits[0], "/") {
+			return nil, fmt.Errorf("Rule '%s' should have '<json pointer>=<action>' format", item)
+		}
+
+		switch bits[1] {
+		case redactRemove, redactMask, redactHash:
+		default:
+			return nil, fmt.Errorf("Unknown action '%s' in rule '%s', should be one of: remove, mask, hash", bits[1], item)
+		}
+		if bits[1] == redactHash && hashKey == nil {
+			return nil, fmt.Errorf("Rule '%s' needs hash key", item)
+		}
+
+		var pointer []string
+		for _, token := range strings.Split(bits[0][1:], "/") {
+			token = strings.Replace(token, "~1", "/", -1)
+			token = strings.Replace(token, "~0", "~", -1)
+			pointer = append(pointer, token)
+		}
+		rules = append(rules, redactRule{pointer: pointer, action: bits[1], key: hashKey})
+	}
+	return rules, nil
+}
+
+func redactValue(value interface{}, action string, key *Secret) interface{} {
+	var str string
+	switch v := value.(type) {
+	case string:
+		str = v
+	case json.Number:
+		str = v.String()
+	default:
+		raw, _ := json.Marshal(v)
+		str = string(raw)
+	}
+
+	if action == redactHash {
+		mac := hmac.New(sha256.New, []byte(key.Value()))
+		mac.Write([]byte(str))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	// Mask keeping last 4 characters, not bytes, so multibyte values are not cut
+	runes := []rune(str)
+	if len(runes) <= 4 {
+		return strings.Repeat("*", len(runes))
+	}
+	return strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-4:])
+}
+
+// Walks pointer inside node and applies action to the value it points to.
+// Non numeric token applied to an array is applied to every array item,
+// so `/items/card` redacts card of every item. Removed array items are set
+// to null, to keep other items indexes.
+func applyRedaction(node interface{}, pointer []string, action string, key *Secret) {
+	token, rest := pointer[0], pointer[1:]
+
+	switch v := node.(type) {
+	case map[string]interface{}:
+		child, ok := v[token]
+		if !ok {
+			return
+		}
+		if len(rest) > 0 {
+			applyRedaction(child, rest, action, key)
+		} else if action == redactRemove {
+			delete(v, token)
+		} else {
+			v[token] = redactValue(child, action, key)
+		}
+	case []interface{}:
+		i, err := strconv.Atoi(token)
+		if err != nil {
+			for _, item := range v {
+				applyRedaction(item, pointer, action, key)
+			}
+			return
+		}
+		if i < 0 || i >= len(v) {
+			return
+		}
+		if len(rest) > 0 {
+			applyRedaction(v[i], rest, action, key)
+		} else if action == redactRemove {
+			v[i] = nil
+		} else {
+			v[i] = redactValue(v[i], action, key)
+		}
+	}
+}
+
+func isJSON(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+func isJSONResponse(resp *http.Response) bool {
+	return isJSON(resp.Header)
+}
+
+// Removes, masks or hashes fields of upstream JSON responses. Only upstream paths starting with one of
+// paths prefixes are transformed, or all if empty. Bodies, up to maxSize bytes, are buffered
+// and rewritten, and gzip encoded ones are sent to client decoded. Bodies which are larger,
+// or use other content encodings, or do not fit into shared buffer budget, are passed untouched
+// or replaced with 502, if block is set. Responses without body, e.g. to HEAD, are passed as is.
+func JSONRedaction(spec string, hashKey *Secret, paths string, maxSize int64, block bool) ProxyOption {
+	rules, err := parseRedactRules(spec, hashKey)
+	if err != nil {
+		log.Fatal("Can't parse JSON redaction rules ", err)
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	prefixes := splitList(paths)
+
+	// Called when body can't be transformed, body stays untouched
+	skip := func(resp *http.Response, reason string) error {
+		if block {
+			return fmt.Errorf("JSON response can't be redacted: %s %s", resp.Request.URL.Path, reason)
+		}
+		log.Println("Passing JSON response without redaction", resp.Request.URL.Path, reason)
+		return nil
+	}
+
+	return func(proxy *httputil.ReverseProxy) {
+		appendModifyResponse(proxy, func(resp *http.Response) error {
+			if !isJSONResponse(resp) || !hasAnyPrefix(resp.Request.URL.Path, prefixes) {
+				return nil
+			}
+			if resp.Request.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent ||
+				resp.StatusCode == http.StatusNotModified || resp.ContentLength == 0 {
+				return nil
+			}
+
+			encoding := resp.Header.Get("Content-Encoding")
+			if encoding != "" && encoding != "identity" && encoding != "gzip" {
+				return skip(resp, "unsupported content encoding "+encoding)
+			}
+			if resp.ContentLength > maxSize {
+				return skip(resp, "body too large")
+			}
+
+			// Every buffer is reserved before it is filled, and returned once client got the response.
+			// Upstream body is buffered as is, so its size is known unless it is not sent.
+			upstream := resp.Body
+			body := &pooledBody{upstream: upstream}
+			reserved := maxSize
+			if resp.ContentLength >= 0 {
+				reserved = resp.ContentLength
+			}
+			if !body.reserve(reserved) {
+				return skip(resp, "buffer budget exhausted")
+			}
+			raw := getBuffer()
+			body.Reader, body.buffers = raw, []*bytes.Buffer{raw}
+			resp.Body = body
+
+			if _, err := raw.ReadFrom(io.LimitReader(upstream, maxSize+1)); err != nil {
+				return err
+			}
+			if int64(raw.Len()) > maxSize {
+				body.Reader = io.MultiReader(raw, upstream)
+				return skip(resp, "body too large")
+			}
+			upstream.Close()
+
+			decoded := raw.Bytes()
+			if encoding == "gzip" {
+				// Decoded size is not known up front
+				if !body.reserve(maxSize) {
+					return skip(resp, "buffer budget exhausted")
+				}
+				zr, err := gzip.NewReader(bytes.NewReader(decoded))
+				if err == nil {
+					unzipped := getBuffer()
+					body.buffers = append(body.buffers, unzipped)
+					_, err = unzipped.ReadFrom(io.LimitReader(zr, maxSize+1))
+					decoded = unzipped.Bytes()
+				}
+				if err != nil {
+					return skip(resp, "malformed gzip body")
+				}
+				if int64(len(decoded)) > maxSize {
+					return skip(resp, "body too large")
+				}
+			}
+
+			// Nothing to redact, upstream body is sent as it was read
+			if len(bytes.TrimSpace(decoded)) == 0 {
+				return nil
+			}
+			decoder := json.NewDecoder(bytes.NewReader(decoded))
+			decoder.UseNumber()
+			var doc interface{}
+			if err := decoder.Decode(&doc); err != nil {
+				return skip(resp, "malformed JSON")
+			}
+
+			for _, rule := range rules {
+				applyRedaction(doc, rule.pointer, rule.action, rule.key)
+			}
+
+			out := getBuffer()
+			body.buffers = append(body.buffers, out)
+			encoder := json.NewEncoder(out)
+			encoder.SetEscapeHTML(false)
+			if err := encoder.Encode(doc); err != nil {
+				return err
+			}
+			if !body.reserve(int64(out.Len())) {
+				return skip(resp, "buffer budget exhausted")
+			}
+
+			body.Reader = out
+			// Trailers, known once upstream body was read, can be sent only with chunked encoding
+			if len(resp.Trailer) > 0 {
+				resp.ContentLength = -1
+				resp.Header.Del("Content-Length")
+			} else {
+				resp.ContentLength = int64(out.Len())
+				resp.Header.Set("Content-Length", strconv.Itoa(out.Len()))
+			}
+			resp.Header.Del("Content-Encoding")
+			// Body changed, so it is not byte-for-byte equal to upstream one anymore
+			if etag := resp.Header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				resp.Header.Set("Etag", "W/"+etag)
+			}
+			return nil
+		})
+	}
+}
+
+// Empty prefixes list matches any path
+func hasAnyPrefix(path string, prefixes []string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func gzipBytes(s string) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.WriteString(zw, s)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// Proxy with JSON redaction in front of upstream sending body with given encoding
+func newRedactingProxy(t testing.TB, body []byte, encoding string, maxSize int64, block bool) http.Handler {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		w.Write(body)
+	}))
+	t.Cleanup(upstream.Close)
+
+	target, _ := url.Parse(upstream.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = &http.Transport{DisableCompression: true}
+	proxy.ErrorLog = log.New(io.Discard, "", 0)
+	return ApplyProxyOptions(proxy, JSONRedaction("/ssn=mask", nil, "", maxSize, block))
+}
+
+func setBufferBudget(t testing.TB, limit int64) {
+	previous := buffers.limit
+	buffers.limit = limit
+	t.Cleanup(func() { buffers.limit = previous })
+}
+
+// Compressed body is small, but decoded and rewritten copies are buffered too
+func TestJSONRedactionBudgetGzip(t *testing.T) {
+	doc := `{"ssn":"123456789","pad":"` + strings.Repeat("a", 4000) + `"}`
+	compressed := gzipBytes(doc)
+	setBufferBudget(t, int64(len(compressed))+1024)
+	h := newRedactingProxy(t, compressed, "gzip", 64<<10, true)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502 as budget can't fit decoded body", w.Code)
+	}
+	if used := atomic.LoadInt64(&buffers.used); used != 0 {
+		t.Errorf("buffer budget used after request = %d, want 0", used)
+	}
+}
+
+func TestJSONRedactionBudgetStress(t *testing.T) {
+	doc := `{"ssn":"123456789","pad":"` + strings.Repeat("a", 2000) + `"}`
+	const maxSize = 8 << 10
+	limit := int64(4 * maxSize)
+	setBufferBudget(t, limit)
+
+	for _, encoding := range []string{"", "gzip"} {
+		body := []byte(doc)
+		if encoding == "gzip" {
+			body = gzipBytes(doc)
+		}
+		h := newRedactingProxy(t, body, encoding, maxSize, true)
+
+		// Samples usage, which should never go over the limit
+		var peak int64
+		done, sampled := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(sampled)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if used := atomic.LoadInt64(&buffers.used); used > atomic.LoadInt64(&peak) {
+					atomic.StoreInt64(&peak, used)
+				}
+				time.Sleep(10 * time.Microsecond)
+			}
+		}()
+
+		var wg sync.WaitGroup
+		var redacted, blocked int64
+		for i := 0; i < 200; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+				switch {
+				case w.Code == http.StatusBadGateway:
+					atomic.AddInt64(&blocked, 1)
+				case strings.Contains(w.Body.String(), `"ssn":"*****6789"`):
+					atomic.AddInt64(&redacted, 1)
+				default:
+					t.Errorf("encoding %q: response passed without redaction: %d %.40s", encoding, w.Code, w.Body.String())
+				}
+			}()
+		}
+		wg.Wait()
+		close(done)
+		<-sampled
+
+		if peak > limit {
+			t.Errorf("encoding %q: buffer budget peaked at %d, limit %d", encoding, peak, limit)
+		}
+		if used := atomic.LoadInt64(&buffers.used); used != 0 {
+			t.Errorf("encoding %q: buffer budget used after requests = %d, want 0", encoding, used)
+		}
+		if redacted == 0 {
+			t.Errorf("encoding %q: no response was redacted, %d blocked", encoding, blocked)
+		}
+	}
+}
+
+var testHashKey = LoadSecret("redact-json-hash-key", "test-key")
+
+func hashOf(s string) string {
+	mac := hmac.New(sha256.New, []byte("test-key"))
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestRedactValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		action string
+		want   interface{}
+	}{
+		{"mask", "123456789", redactMask, "*****6789"},
+		{"mask short", "123", redactMask, "***"},
+		{"mask number", json.Number("4111111111111111"), redactMask, "************1111"},
+		{"mask multibyte", "Zoë Émile Ünal", redactMask, "**********Ünal"},
+		{"mask multibyte tail", "card ☃☃☃☃", redactMask, "*****☃☃☃☃"},
+		{"mask short multibyte", "☃☃", redactMask, "**"},
+		{"hash", "123456789", redactHash, hashOf("123456789")},
+		{"hash object", map[string]interface{}{"a": "b"}, redactHash, hashOf(`{"a":"b"}`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := redactValue(tt.value, tt.action, testHashKey)
+			if got != tt.want {
+				t.Errorf("redactValue() = %v, want %v", got, tt.want)
+			}
+			if s, ok := got.(string); ok && !utf8.ValidString(s) {
+				t.Errorf("redactValue() = %q is not valid UTF-8", s)
+			}
+		})
+	}
+}
+
+func TestParseRedactRules(t *testing.T) {
+	rules, err := parseRedactRules("/ssn=remove, /card/number=mask,/a~1b/c~0d=hash", testHashKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []redactRule{
+		{[]string{"ssn"}, redactRemove, testHashKey},
+		{[]string{"card", "number"}, redactMask, testHashKey},
+		{[]string{"a/b", "c~d"}, redactHash, testHashKey},
+	}
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("rules = %v, want %v", rules, want)
+	}
+
+	for _, spec := range []string{"ssn=remove", "/ssn", "/ssn=encrypt"} {
+		if _, err := parseRedactRules(spec, testHashKey); err == nil {
+			t.Errorf("parseRedactRules(%q) accepted invalid rule", spec)
+		}
+	}
+	// Plain hashes of short values are reversed by trying them all
+	if _, err := parseRedactRules("/ssn=hash", nil); err == nil {
+		t.Error("hash rule accepted without key")
+	}
+	if _, err := parseRedactRules("/ssn=mask", nil); err != nil {
+		t.Errorf("mask rule needs no key: %v", err)
+	}
+}
+
+func TestApplyRedaction(t *testing.T) {
+	tests := []struct {
+		name string
+		spec string
+		doc  string
+		want string
+	}{
+		{"remove", "/ssn=remove", `{"ssn":"123456789","name":"a"}`, `{"name":"a"}`},
+		{"nested", "/card/number=mask", `{"card":{"number":"4111111111111111"}}`, `{"card":{"number":"************1111"}}`},
+		{"array of objects", "/items/card=mask", `{"items":[{"card":"12345"},{"card":"67890"},{"other":1}]}`, `{"items":[{"card":"*2345"},{"card":"*7890"},{"other":1}]}`},
+		{"array index", "/items/1=mask", `{"items":["12345","67890"]}`, `{"items":["12345","*7890"]}`},
+		{"removed array item keeps indexes", "/items/0=remove", `{"items":["a","b"]}`, `{"items":[null,"b"]}`},
+		{"top level array", "/ssn=mask", `[{"ssn":"123456789"},{"ssn":"987654321"}]`, `[{"ssn":"*****6789"},{"ssn":"*****4321"}]`},
+		{"missing pointer", "/card/number=remove", `{"card":"none","ssn":"1"}`, `{"card":"none","ssn":"1"}`},
+		{"index out of range", "/items/5=remove", `{"items":["a"]}`, `{"items":["a"]}`},
+		{"escaped token", "/a~1b=remove", `{"a/b":1,"a":{"b":2}}`, `{"a":{"b":2}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := parseRedactRules(tt.spec, testHashKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoder := json.NewDecoder(strings.NewReader(tt.doc))
+			decoder.UseNumber()
+			var doc interface{}
+			if err := decoder.Decode(&doc); err != nil {
+				t.Fatal(err)
+			}
+			for _, rule := range rules {
+				applyRedaction(doc, rule.pointer, rule.action, rule.key)
+			}
+			if got, _ := json.Marshal(doc); string(got) != tt.want {
+				t.Errorf("document = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONRedaction(t *testing.T) {
+	doc := `{"ssn":"123456789","name":"a"}`
+	large := `{"ssn":"123456789","pad":"` + strings.Repeat("a", 2048) + `"}`
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		block    bool
+		status   int
+		want     string
+	}{
+		{"plain", []byte(doc), "", false, http.StatusOK, `{"name":"a","ssn":"*****6789"}` + "\n"},
+		{"gzip is sent decoded", gzipBytes(doc), "gzip", false, http.StatusOK, `{"name":"a","ssn":"*****6789"}` + "\n"},
+		{"unsupported encoding passes", []byte(doc), "br", false, http.StatusOK, doc},
+		{"unsupported encoding blocked", []byte(doc), "br", true, http.StatusBadGateway, ""},
+		{"too large passes", []byte(large), "", false, http.StatusOK, large},
+		{"too large blocked", []byte(large), "", true, http.StatusBadGateway, ""},
+		{"malformed passes", []byte(`{"ssn":`), "", false, http.StatusOK, `{"ssn":`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newRedactingProxy(t, tt.body, tt.encoding, 1024, tt.block)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.want != "" && w.Body.String() != tt.want {
+				t.Errorf("body = %.80q, want %.80q", w.Body.String(), tt.want)
+			}
+			if tt.status == http.StatusOK && tt.encoding == "gzip" && w.Header().Get("Content-Encoding") != "" {
+				t.Errorf("Content-Encoding %q kept on decoded body", w.Header().Get("Content-Encoding"))
+			}
+		})
+	}
+	if used := atomic.LoadInt64(&buffers.used); used != 0 {
+		t.Errorf("buffer budget used after requests = %d, want 0", used)
+	}
+}
+
+// Responses without body have nothing to redact, and are never blocked
+func TestJSONRedactionNoBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		status int
+	}{
+		{"HEAD", http.MethodHead, http.StatusOK},
+		{"no content", http.MethodGet, http.StatusNoContent},
+		{"not modified", http.MethodGet, http.StatusNotModified},
+		{"empty body", http.MethodGet, http.StatusOK},
+		{"empty gzip body", http.MethodPost, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if r.Method == http.MethodPost {
+					w.Header().Set("Content-Encoding", "gzip")
+					w.Write(gzipBytes(""))
+					return
+				}
+				if r.Method == http.MethodHead {
+					w.Header().Set("Content-Length", "42")
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer upstream.Close()
+
+			target, _ := url.Parse(upstream.URL)
+			proxy := httputil.NewSingleHostReverseProxy(target)
+			proxy.Transport = &http.Transport{DisableCompression: true}
+			proxy.ErrorLog = log.New(io.Discard, "", 0)
+			h := ApplyProxyOptions(proxy, JSONRedaction("/ssn=mask", nil, "", 1024, true))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(tt.method, "/", nil))
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	phaseStarting      = "starting"
+	phaseConfigLoaded  = "config-loaded"
+	phasePluginsLoaded = "plugins-loaded"
+	phaseListenerBound = "listener-bound"
+	phaseReady         = "ready"
+	phaseDraining      = "draining"
+	phaseStopped       = "stopped"
+)
+
+// Dropped once draining started, e.g. by a signal while plugins were loading,
+// so a stopping server never reports itself ready
+var startupPhases = map[string]bool{
+	phaseConfigLoaded:  true,
+	phasePluginsLoaded: true,
+	phaseListenerBound: true,
+	phaseReady:         true,
+}
+
+type LifecycleEvent struct {
+	Phase  string      `json:"phase"`
+	Time   time.Time   `json:"time"`
+	Detail interface{} `json:"detail,omitempty"`
+}
+
+// Single source of truth about server lifecycle. Logs, readiness, admin API
+// and event stream for orchestration tools all derive from it.
+type lifecycleBus struct {
+	sync.Mutex
+	events      []LifecycleEvent
+	subscribers []func(LifecycleEvent)
+	draining    bool
+	// Held while subscribers run, instead of the bus lock, so slow subscribers, like
+	// a named pipe nobody reads yet, do not block readiness and admin API. Keeps
+	// events in order for every subscriber.
+	delivering sync.Mutex
+}
+
+var lifecycle = &lifecycleBus{}
+
+func (b *lifecycleBus) Subscribe(fn func(LifecycleEvent)) {
+	b.Lock()
+	defer b.Unlock()
+	b.subscribers = append(b.subscribers, fn)
+}
+
+// Records event and passes it to subscribers. Subscribers can read the bus, but
+// should not emit events themselves.
+func (b *lifecycleBus) Emit(phase string, detail interface{}) {
+	b.Lock()
+	if b.draining && startupPhases[phase] {
+		b.Unlock()
+		return
+	}
+	b.draining = b.draining || phase == phaseDraining
+	event := LifecycleEvent{Phase: phase, Time: time.Now(), Detail: detail}
+	b.events = append(b.events, event)
+	subscribers := append([]func(LifecycleEvent){}, b.subscribers...)
+	// Taken before the bus lock is released, so events are delivered in the order they are recorded
+	b.delivering.Lock()
+	b.Unlock()
+
+	defer b.delivering.Unlock()
+	for _, fn := range subscribers {
+		fn(event)
+	}
+}
+
+func (b *lifecycleBus) Draining() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.draining
+}
+
+func (b *lifecycleBus) Phase() string {
+	b.Lock()
+	defer b.Unlock()
+
+	if len(b.events) == 0 {
+		return phaseStarting
+	}
+	return b.events[len(b.events)-1].Phase
+}
+
+func (b *lifecycleBus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	// Copied, so slow admin client does not hold back Emit and readiness
+	b.Lock()
+	events := append([]LifecycleEvent{}, b.events...)
+	b.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// Writes lifecycle events as JSON lines to "stdout", or to a file or named pipe at given path
+func LifecycleEvents(output string) {
+	lifecycle.Subscribe(func(event LifecycleEvent) {
+		log.Println("Lifecycle phase", event.Phase)
+	})
+
+	if output == "" {
+		return
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "stdout" {
+		// Opening named pipe blocks until somebody reads it
+		f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal("Can't open lifecycle events output ", err)
+		}
+		w = f
+	}
+
+	encoder := json.NewEncoder(w)
+	lifecycle.Subscribe(func(event LifecycleEvent) {
+		if err := encoder.Encode(event); err != nil {
+			log.Println("Can't write lifecycle event", event.Phase, err)
+		}
+	})
+}
+
+// Stops accepting new connections on SIGINT or SIGTERM, and waits up to
+// timeout for in-flight requests. Returned channel is closed when done.
+func ShutdownOnSignal(server *http.Server, timeout time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		lifecycle.Emit(phaseDraining, nil)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Println("Can't drain connections gracefully", err)
+		}
+		close(done)
+	}()
+
+	return done
+}
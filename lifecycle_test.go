@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLifecycleDrainingDuringStartup(t *testing.T) {
+	bus := &lifecycleBus{}
+	var seen []string
+	bus.Subscribe(func(event LifecycleEvent) {
+		seen = append(seen, event.Phase)
+	})
+
+	// Signal arrives while plugins are loading
+	bus.Emit(phaseConfigLoaded, nil)
+	bus.Emit(phaseDraining, nil)
+	bus.Emit(phasePluginsLoaded, nil)
+	bus.Emit(phaseListenerBound, nil)
+	bus.Emit(phaseReady, nil)
+	bus.Emit(phaseStopped, nil)
+
+	want := []string{phaseConfigLoaded, phaseDraining, phaseStopped}
+	if !reflect.DeepEqual(seen, want) {
+		t.Errorf("phases = %v, want %v", seen, want)
+	}
+	if !bus.Draining() || bus.Phase() != phaseStopped {
+		t.Errorf("draining %v, phase %s", bus.Draining(), bus.Phase())
+	}
+}
+
+func TestLifecycleSubscribersOutsideLock(t *testing.T) {
+	bus := &lifecycleBus{}
+	var phases []string
+	bus.Subscribe(func(event LifecycleEvent) {
+		// Reading the bus from a subscriber does not deadlock
+		phases = append(phases, bus.Phase())
+	})
+	release := make(chan struct{})
+	bus.Subscribe(func(event LifecycleEvent) {
+		if event.Phase == phaseReady {
+			<-release
+		}
+	})
+
+	bus.Emit(phaseConfigLoaded, nil)
+	emitted := make(chan struct{})
+	go func() {
+		bus.Emit(phaseReady, nil)
+		close(emitted)
+	}()
+
+	// Blocked subscriber does not block readers of the bus
+	deadline := time.Now().Add(5 * time.Second)
+	for bus.Phase() != phaseReady {
+		if time.Now().After(deadline) {
+			t.Fatal("ready was not recorded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	w := httptest.NewRecorder()
+	bus.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/__proxy/lifecycle", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status %d", w.Code)
+	}
+	close(release)
+	<-emitted
+
+	want := []string{phaseConfigLoaded, phaseReady}
+	if !reflect.DeepEqual(phases, want) {
+		t.Errorf("phases = %v, want %v", phases, want)
+	}
+}
+
+// Response writer stuck in Write, like admin client which stopped reading
+type blockedWriter struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	release chan struct{}
+}
+
+func newBlockedWriter() *blockedWriter {
+	return &blockedWriter{httptest.NewRecorder(), make(chan struct{}), make(chan struct{})}
+}
+
+func (w *blockedWriter) Write(p []byte) (int, error) {
+	close(w.writing)
+	<-w.release
+	return w.ResponseRecorder.Write(p)
+}
+
+// Calls fn, failing if it does not return while admin client is stuck
+func withBlockedAdmin(t *testing.T, serve http.HandlerFunc, fn func()) {
+	w := newBlockedWriter()
+	served := make(chan struct{})
+	go func() {
+		serve(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		close(served)
+	}()
+	<-w.writing
+
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("blocked by slow admin client")
+	}
+	close(w.release)
+	<-served
+	<-done
+}
+
+func TestLifecycleSlowAdminClient(t *testing.T) {
+	bus := &lifecycleBus{}
+	bus.Emit(phaseConfigLoaded, nil)
+	withBlockedAdmin(t, bus.ServeHTTP, func() {
+		bus.Emit(phaseDraining, nil)
+		bus.Phase()
+		bus.Draining()
+	})
+}
+
+func TestArchiveStateSlowAdminClient(t *testing.T) {
+	withBlockedAdmin(t, archiveHandler, func() {
+		takeForcedSample("/")
+	})
+}
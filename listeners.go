@@ -0,0 +1,50 @@
+package main
+
+import (
+	"expvar"
+	"net"
+	"os"
+	"strings"
+)
+
+// Accepted connections by listener address
+var listenerConnections = expvar.NewMap("listener_connections")
+
+type countingListener struct {
+	net.Listener
+	label string
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		listenerConnections.Add(l.label, 1)
+	}
+	return conn, err
+}
+
+// Binds every address of comma separated list, e.g. `0.0.0.0:9090,[::1]:9090,unix:/run/proxy.sock`.
+// Fails if any of them can't be bound, closing ones already bound.
+func Listen(addresses string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, addr := range splitList(addresses) {
+		network := "tcp"
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			network, addr = "unix", path
+			// Socket left by previous run, which was not shut down cleanly
+			if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+				os.Remove(path)
+			}
+		}
+
+		listener, err := net.Listen(network, addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, countingListener{listener, listener.Addr().String()})
+	}
+	return listeners, nil
+}
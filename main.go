@@ -1,8 +1,6 @@
 package main
 
 import (
-	"context"
-	"encoding/base64"
 	"flag"
 	"fmt"
 	"log"
@@ -12,7 +10,9 @@ import (
 	"os"
 	"plugin"
 	"reflect"
-	"strings"
+	"strconv"
+	"sync/atomic"
+	"time"
 )
 
 // Middleware approach based on Mat Ryer article
@@ -30,40 +30,14 @@ func Chain(h http.Handler, mws ...Middleware) http.Handler {
 	return h
 }
 
-func BasicAuth(login, password string) Middleware {
-	if login == "" || password == "" {
-		return nil
-	}
-
-	return func(h http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			log.Println("Basic auth")
-
-			token := r.Header.Get("Authorization")
-			bits := strings.Split(token, " ")
-			if len(bits) != 2 {
-				w.Header().Add("WWW-Authenticate", "realm=proxy")
-				http.Error(w, "Basic auth header not found or malformed", http.StatusUnauthorized)
-				return
-			}
-			authvaluesStr, _ := base64.StdEncoding.DecodeString(bits[1])
-			authValues := strings.Split(string(authvaluesStr), ":")
-
-			if authValues[0] != login && authValues[1] != password {
-				http.Error(w, "Basic auth header not found or malformed", http.StatusUnauthorized)
-				return
-			}
-
-			// Set value which be available to all middlewares
-			ctx := context.WithValue(r.Context(), "Username", login)
-			h.ServeHTTP(w, r.WithContext(ctx))
-		})
-	}
+func patchPath(component string) string {
+	return "./patches/" + component + ".so"
 }
 
 func LoadPatch(component string, symbol string) (interface{}, error) {
-	plugin_path := "./patches/" + component + ".so"
-	if _, err := os.Stat(plugin_path); err == nil {
+	plugin_path := patchPath(component)
+	if _, err := os.Stat(plugin_path); err == nil && !pluginSkipped(plugin_path) {
+		preflight(plugin_path)
 		return LoadPlugin(plugin_path, symbol)
 	}
 
@@ -71,16 +45,18 @@ func LoadPatch(component string, symbol string) (interface{}, error) {
 }
 
 func LoadMiddlewarePlugin(path string) Middleware {
-	if path == "" {
+	if path == "" || pluginSkipped(path) {
 		return nil
 	}
 
+	preflight(path)
 	symbol, err := LoadPlugin(path, "Middleware")
 	if err != nil {
 		log.Fatal("Can't load plugin", path, err)
 	}
 
 	if mw, ok := symbol.(func(http.Handler) http.Handler); ok {
+		registerPlugin(path, "Middleware")
 		return mw
 	} else {
 		log.Fatal("'Middleware' function should have `func(http.Handler) http.Handler` type", path, ok, reflect.TypeOf(symbol))
@@ -106,6 +82,13 @@ func LoadPlugin(path string, symbol string) (interface{}, error) {
 // Intentionally contains bug, which do not respect `prefix` variable
 // Use `patch` to fix the code
 func Proxy(target *url.URL, prefix string) http.Handler {
+	return proxyFor(NewProxyTarget(NewProxyConfig(target, prefix)))
+}
+
+// Proxy reading its config from upstream for every request.
+// Patched proxy receives target and prefix once, and does not see swaps.
+func proxyFor(upstream *ProxyTarget) http.Handler {
+	config := upstream.Load()
 	obj, err := LoadPatch("reverse_proxy", "Proxy")
 	if err != nil {
 		log.Println(err)
@@ -115,38 +98,293 @@ func Proxy(target *url.URL, prefix string) http.Handler {
 		if proxy, ok := obj.(func(*url.URL, string) http.Handler); !ok {
 			log.Fatal("Function signature do not match", reflect.TypeOf(obj))
 		} else {
-			return proxy(target, prefix)
+			registerPlugin(patchPath("reverse_proxy"), "Proxy")
+			return proxy(config.Target, config.Prefix)
 		}
 	}
 
-	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy := httputil.NewSingleHostReverseProxy(config.Target)
 	proxy.Director = func(r *http.Request) {
-		r.URL.Scheme = target.Scheme
-		r.URL.Host = target.Host
-		r.Host = target.Host
+		// Loaded once, so request never mixes old and new config
+		config := upstream.Load()
+		r.URL.Scheme = config.Target.Scheme
+		r.URL.Host = config.Target.Host
+		r.Host = config.Target.Host
+	}
+
+	return proxy
+}
+
+// Settings used by Proxy for every request. Compiled once and never modified,
+// changes are made by swapping the whole config.
+type ProxyConfig struct {
+	Target *url.URL
+	Prefix string
+}
+
+func NewProxyConfig(target *url.URL, prefix string) *ProxyConfig {
+	// Copy, so caller can't change the target later
+	targetCopy := *target
+	return &ProxyConfig{Target: &targetCopy, Prefix: prefix}
+}
+
+// Config of one proxy, shared with everything else reading its target, like health check,
+// forward mode, access log and routes, so a swap changes all of them at once
+type ProxyTarget struct {
+	config atomic.Pointer[ProxyConfig]
+}
+
+func NewProxyTarget(config *ProxyConfig) *ProxyTarget {
+	t := &ProxyTarget{}
+	t.config.Store(config)
+	return t
+}
+
+func (t *ProxyTarget) Load() *ProxyConfig {
+	return t.config.Load()
+}
+
+// Replaces config, requests in flight keep the one they started with
+func (t *ProxyTarget) Swap(config *ProxyConfig) *ProxyConfig {
+	return t.config.Swap(config)
+}
+
+// Upstream of access log records. Synthetic responses are labeled,
+// so they are never mistaken for real traffic.
+func (t *ProxyTarget) Label() string {
+	if t == nil {
+		return ""
+	}
+	target := t.Load().Target
+	if target.Scheme == syntheticScheme {
+		return syntheticScheme + "://" + target.Host
 	}
+	return target.Host
+}
 
+// ProxyOption adjusts the ReverseProxy returned by Proxy, so built-in
+// features keep working even when the proxy itself was patched
+type ProxyOption func(*httputil.ReverseProxy)
+
+func ApplyProxyOptions(h http.Handler, opts ...ProxyOption) http.Handler {
+	proxy, ok := h.(*httputil.ReverseProxy)
+	if !ok {
+		log.Println("Proxy is not *httputil.ReverseProxy, ignoring proxy options", reflect.TypeOf(h))
+		return h
+	}
+
+	for _, opt := range opts {
+		if opt != nil {
+			opt(proxy)
+		}
+	}
 	return proxy
 }
 
+// Runs fn after ModifyResponse already defined on the proxy, e.g. by a patch
+func appendModifyResponse(proxy *httputil.ReverseProxy, fn func(*http.Response) error) {
+	next := proxy.ModifyResponse
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if next != nil {
+			if err := next(resp); err != nil {
+				return err
+			}
+		}
+		return fn(resp)
+	}
+}
+
 func main() {
-	port := flag.String("port", ":9090", "Proxy listen address: ':9090'")
+	port := flag.String("port", ":9090", "Comma separated list of proxy listen addresses, TCP or 'unix:<path>' sockets, e.g. ':9090,unix:/run/proxy.sock'")
+	bindEarly := flag.Bool("bind-early", false, "Bind listeners before plugins are loaded, answering 503 until the proxy is ready, e.g. for socket activation")
 	target := flag.String("url", "https://httpbin.org", "Target for proxy. Default: https://httpbin.org")
 	prefix := flag.String("prefix", "", "Root prefix")
 
+	strictRequests := flag.Bool("strict-requests", true, "Reject smuggling-prone requests, like Transfer-Encoding with Content-Length, with 400")
+	strictRequestsExclude := flag.String("strict-requests-exclude", "", "Comma separated list of path prefixes, e.g. of routes used by legacy clients, where -strict-requests does not reject requests")
+
+	forwardMode := flag.Bool("forward-mode", false, "Run as forward proxy, accepting absolute-form and CONNECT requests to the target origin only")
+	forwardAllow := flag.String("forward-allow", "", "Comma separated list of origins allowed in forward mode in addition to the target, e.g. 'https://api.example.com'")
+
 	basicUser := flag.String("basic-user", "", "Set to non empty to enable basic auth")
-	basicPassword := flag.String("basic-password", "", "Set to non empty to enable basic auth")
+	basicPassword := flag.String("basic-password", "", "Set to non empty to enable basic auth. Secret reference: 'env:<VARIABLE>', 'file:<path>' or inline value")
 
 	prePlugin := flag.String("pre-plugin", "", "Path to pre plugin")
 	postPlugin := flag.String("post-plugin", "", "Path to post plugin")
+	flag.DurationVar(&pluginInitTimeout, "plugin-init-timeout", 30*time.Second, "Maximum time to open plugin and run its Init function, unlimited if 0")
+	flag.BoolVar(&pluginOptional, "plugin-optional", false, "Continue without plugins which fail to initialize, instead of failing startup")
+	flag.BoolVar(&strictPlugins, "strict-plugins", false, "Fail startup when plugin exports look like misspelled hooks, or hooks of wrong type")
+
+	contextHeaders := flag.String("context-headers", "", "Comma separated list of '<context key>:<header>[:keep]' entries, sending request context values upstream as headers, e.g. 'identity:X-User'")
+
+	headerAllow := flag.String("response-header-allow", "", "Comma separated list of upstream response headers passed to clients, all others are removed")
+	headerDeny := flag.String("response-header-deny", "", "Comma separated list of upstream response headers removed before reaching clients")
+	headerExpose := flag.String("response-header-expose-prefix", "", "Response headers starting with this prefix bypass allow and deny lists")
+
+	maxBodySize := flag.Int64("max-body-size", 0, "Maximum request body size in bytes, 0 means unlimited")
+
+	maxResponseSize := flag.Int64("max-response-size", 0, "Maximum upstream response body size in bytes, 0 means unlimited")
+	maxResponseSizeExclude := flag.String("max-response-size-exclude", "", "Comma separated list of upstream path prefixes not limited by -max-response-size")
+
+	flag.Int64Var(&buffers.limit, "buffer-budget", 256<<20, "Maximum total size in bytes of bodies buffered at once, e.g. for JSON redaction, 0 means unlimited")
+
+	redactJSON := flag.String("redact-json", "", "Comma separated list of '<json pointer>=<remove|mask|hash>' rules applied to JSON responses, e.g. '/ssn=remove,/card/number=mask'")
+	redactJSONPaths := flag.String("redact-json-paths", "", "Comma separated list of upstream path prefixes where JSON redaction applies. All paths if empty")
+	redactJSONMaxSize := flag.Int64("redact-json-max-size", 1<<20, "Maximum JSON body size in bytes buffered for redaction")
+	redactJSONHashKey := flag.String("redact-json-hash-key", "", "HMAC key of 'hash' redaction rules, required by them. Secret reference: 'env:<VARIABLE>', 'file:<path>' or inline value")
+	redactJSONBlock := flag.Bool("redact-json-block", false, "Respond with 502 instead of passing JSON responses which can't be redacted, e.g. too large")
+
+	upstreamMaxConcurrency := flag.Int("upstream-max-concurrency", 0, "Maximum concurrent upstream requests, 0 means unlimited")
+	upstreamQueueDepth := flag.Int("upstream-queue-depth", 100, "Maximum requests waiting for upstream concurrency slot")
+	upstreamQueueTimeout := flag.Duration("upstream-queue-timeout", 5*time.Second, "Maximum time request waits for upstream concurrency slot")
+
+	upstreamThrottlePolicy := flag.String("upstream-throttle-policy", ThrottlePassthrough, "Upstream throttling responses: 'passthrough' sends them untouched, 'translate' replaces body with proxy error format, keeping Retry-After")
+	upstreamThrottleStatuses := flag.String("upstream-throttle-statuses", "429", "Comma separated upstream statuses treated as throttling, e.g. '429,503'")
+
+	upstreamConnMaxLifetime := flag.Duration("upstream-conn-max-lifetime", 0, "Close upstream connections after this age, disabled if 0")
+	upstreamConnMaxRequests := flag.Int("upstream-conn-max-requests", 0, "Close upstream connections after this number of requests, disabled if 0")
+
+	staticDir := flag.String("static-dir", "", "Folder with static files served by proxy itself, instead of upstream")
+	staticPrefix := flag.String("static-prefix", "/static/", "Path prefix of static files, should end with '/'")
+	staticMaxAge := flag.Duration("static-max-age", time.Hour, "Cache-Control max-age of static files")
+
+	usageAccounting := flag.Bool("usage-accounting", false, "Count request and response bytes per authenticated user")
+	usageReportInterval := flag.Duration("usage-report-interval", 0, "Interval of usage summary log records, disabled if 0")
+
+	debugHeaders := flag.Bool("debug-headers", false, "Explain middleware decisions, like auth rejections, in X-Debug-* response headers")
+	debugHeadersSecret := flag.String("debug-headers-secret", "", "If set, debug headers are sent only for requests with matching X-Debug-Secret header. Secret reference: 'env:<VARIABLE>', 'file:<path>' or inline value")
+
+	secretsWatchInterval := flag.Duration("secrets-watch-interval", 10*time.Second, "How often file backed secrets are checked for changes, disabled if 0")
+	flag.DurationVar(&secretRotationOverlap, "secret-rotation-overlap", 0, "How long previous value of rotated secret stays accepted")
+
+	archiveDir := flag.String("archive-dir", "", "Spool directory of archived request and response pairs, disabled if empty")
+	archiveRate := flag.Float64("archive-rate", 0.001, "Fraction of requests archived, besides 5xx responses and forced samples")
+	archiveMaxBody := flag.Int64("archive-max-body", 64<<10, "Maximum request and response body size in bytes archived, longer ones are truncated")
+	flag.Int64Var(&archiveBuffers.limit, "archive-buffer-budget", 32<<20, "Maximum total size in bytes of bodies captured at once for archiving, 0 means unlimited")
+	archiveMaxSize := flag.Int64("archive-max-size", 100<<20, "Maximum total size in bytes of archive directory, the oldest records are removed first")
+
+	accessLog := flag.String("access-log", "", "Write access log to 'stdout', or to a file at given path. Disabled if empty")
+	accessLogFormat := flag.String("access-log-format", AccessLogText, "Access log format: 'text' or 'json'")
+	accessLogFields := flag.String("access-log-fields", "", "Comma separated list of access log fields, optionally renamed as 'name=field'. Apache combined format fields by default")
+
+	earlyHints := flag.String("early-hints", "", "Link header value sent as '103 Early Hints' before proxying, e.g. '</style.css>; rel=preload; as=style'")
+
+	featureFlags := flag.String("feature-flags", "", "Comma separated list of '<name>=<bool|string|percentage>:<default>' feature flags readable by plugins, e.g. 'beta=percentage:20'")
+
+	adminPort := flag.String("admin-port", "", "Listen address for expvar metrics, readiness and plugin admin routes, e.g. '127.0.0.1:9091'. Disabled if empty")
+	// Name it had before admin API grew beyond metrics
+	flag.StringVar(adminPort, "metrics-port", "", "Deprecated alias of -admin-port")
+	adminAllow := flag.String("admin-allow", "", "Comma separated list of client IPs and CIDR ranges allowed to reach admin endpoints, e.g. '10.0.0.0/8'. Everyone if empty")
+	adminUser := flag.String("admin-basic-user", "", "Set to non empty to require basic auth on admin endpoints")
+	adminPassword := flag.String("admin-basic-password", "", "Password of admin endpoints basic auth. Secret reference: 'env:<VARIABLE>', 'file:<path>' or inline value")
+	healthInformational := flag.String("health-informational", "", "Comma separated list of health checks which do not block readiness")
+
+	lifecycleEvents := flag.String("lifecycle-events", "", "Write lifecycle events as JSON lines to 'stdout', or to a file or named pipe at given path")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "Maximum time to wait for in-flight requests on shutdown")
 
 	flag.Parse()
 
+	LifecycleEvents(*lifecycleEvents)
+
 	rpURL, err := url.Parse(*target)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *forwardMode && *prefix != "" {
+		log.Fatal("Forward mode proxies request URIs as is, and can't be used with -prefix")
+	}
+	FeatureFlags(*featureFlags)
+	lifecycle.Emit(phaseConfigLoaded, nil)
 
-	http.Handle("/", Chain(Proxy(rpURL, *prefix), LoadMiddlewarePlugin(*prePlugin), BasicAuth(*basicUser, *basicPassword), LoadMiddlewarePlugin(*postPlugin)))
-	log.Fatal(http.ListenAndServe(*port, nil))
+	// Strict request validation wraps the gate, so it sees every request in order
+	gate := &startupGate{}
+	server := &http.Server{Handler: Chain(gate, StrictRequests(*strictRequests, *strictRequestsExclude))}
+	drained := ShutdownOnSignal(server, *shutdownTimeout)
+	var served <-chan error
+	if *bindEarly {
+		served = ServeListeners(server, *port, *strictRequests)
+	}
+
+	plugins := []string{*prePlugin, *postPlugin}
+	if _, err := os.Stat(patchPath("reverse_proxy")); err == nil {
+		plugins = append([]string{patchPath("reverse_proxy")}, plugins...)
+	}
+	InitPlugins(plugins...)
+
+	// Shared by proxy and archive, so both hash redacted values the same way
+	redactHashKey := LoadSecret("redact-json-hash-key", *redactJSONHashKey)
+	upstream := NewProxyTarget(NewProxyConfig(rpURL, *prefix))
+	proxy := ApplyProxyOptions(proxyFor(upstream),
+		SyntheticUpstream(rpURL),
+		UpstreamErrors(),
+		UpstreamThrottling(*upstreamThrottlePolicy, *upstreamThrottleStatuses),
+		UpstreamProtocolLabel(),
+		ForwardRouting(*forwardMode),
+		ContextHeaders(*contextHeaders),
+		ResponseHeaderFilter(*headerAllow, *headerDeny, *headerExpose),
+		MaxResponseSize(*maxResponseSize, *maxResponseSizeExclude),
+		JSONRedaction(*redactJSON, redactHashKey, *redactJSONPaths, *redactJSONMaxSize, *redactJSONBlock),
+		UpstreamConnRotation(*upstreamConnMaxLifetime, *upstreamConnMaxRequests),
+		UpstreamConcurrencyLimit(*upstreamMaxConcurrency, *upstreamQueueDepth, *upstreamQueueTimeout))
+
+	if rpURL.Scheme != syntheticScheme {
+		RegisterHealthChecker(upstreamHealthChecker{upstream})
+	}
+	ServeAdmin(*adminPort, ReadyHandler(*healthInformational),
+		AllowClients(*adminAllow), BasicAuth(*adminUser, LoadSecret("admin-basic-password", *adminPassword)))
+
+	handler := Chain(proxy, UsageAccounting(*usageAccounting, *usageReportInterval), DecisionTrail(), BodyArchive(*archiveDir, *archiveRate, *archiveMaxBody, *archiveMaxSize, *redactJSON, redactHashKey), ProtocolLabels(), AccessLog(*accessLog, *accessLogFormat, *accessLogFields, upstream), DebugHeaders(*debugHeaders, LoadSecret("debug-headers-secret", *debugHeadersSecret)), ForwardOrigins(*forwardMode, upstream, *forwardAllow), MaxBodySize(*maxBodySize), LoadMiddlewarePlugin(*prePlugin), BasicAuth(*basicUser, LoadSecret("basic-password", *basicPassword)), LoadMiddlewarePlugin(*postPlugin), StaticFiles(*staticDir, *staticPrefix, *staticMaxAge), EarlyHints(*earlyHints), AccessLogCapture(), ForwardTunnel(*forwardMode))
+	WatchSecrets(*secretsWatchInterval)
+
+	auth, routePlugins := []string{}, []string{}
+	if *basicUser != "" && *basicPassword != "" {
+		auth = append(auth, "basic")
+	}
+	for _, path := range []string{*prePlugin, *postPlugin} {
+		if path != "" && !pluginSkipped(path) {
+			routePlugins = append(routePlugins, path)
+		}
+	}
+	if *staticDir != "" {
+		RegisterRoute(RouteInfo{Match: *staticPrefix, Target: "static files", Auth: auth, Plugins: routePlugins,
+			Limits: map[string]string{"cache_max_age": staticMaxAge.String()}})
+	}
+	proxyRoute := RouteInfo{Match: "/", upstream: upstream, Auth: auth, Plugins: routePlugins, Limits: map[string]string{
+		"max_body_size":            strconv.FormatInt(*maxBodySize, 10),
+		"max_response_size":        strconv.FormatInt(*maxResponseSize, 10),
+		"upstream_max_concurrency": strconv.Itoa(*upstreamMaxConcurrency),
+		"upstream_queue_timeout":   upstreamQueueTimeout.String(),
+	}}
+	if *prefix != "" {
+		proxyRoute.Rewrite = "prefix " + *prefix
+	}
+	if *forwardMode {
+		proxyRoute.Match = "absolute-form and CONNECT requests"
+		SetUnmatchedRoutePolicy("rejected: 400 for origin-form requests, 403 for origins not allowed")
+	} else {
+		SetUnmatchedRoutePolicy("none: all paths are proxied to target")
+	}
+	RegisterRoute(proxyRoute)
+
+	// ServeMux answers CONNECT requests itself, so forward mode serves the chain directly
+	if !*forwardMode {
+		mux := http.NewServeMux()
+		mux.Handle("/", handler)
+		handler = mux
+	}
+	gate.Set(handler)
+	lifecycle.Emit(phasePluginsLoaded, pluginsSnapshot())
+
+	// Signal during startup already shut the server down, so nothing is bound anymore
+	if !*bindEarly && !lifecycle.Draining() {
+		served = ServeListeners(server, *port, *strictRequests)
+	}
+	lifecycle.Emit(phaseReady, nil)
+	if served != nil {
+		if err := <-served; err != nil {
+			log.Fatal(err)
+		}
+	}
+	<-drained
+	lifecycle.Emit(phaseStopped, nil)
 }
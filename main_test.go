@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func BenchmarkProxyDirector(b *testing.B) {
+	target, _ := url.Parse("http://upstream.example:8080")
+	proxy := Proxy(target, "").(*httputil.ReverseProxy)
+	r := httptest.NewRequest("GET", "/a?b=c", nil)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		proxy.Director(r)
+	}
+}
+
+// Requests racing with config swaps see either the old or the new config in full
+func TestProxyTargetSwap(t *testing.T) {
+	var upstreams []*url.URL
+	for i := 0; i < 2; i++ {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Host header and connection should both point to this upstream
+			if r.Host != r.Context().Value(http.LocalAddrContextKey).(net.Addr).String() {
+				w.WriteHeader(http.StatusConflict)
+			}
+		}))
+		defer server.Close()
+		target, _ := url.Parse(server.URL)
+		upstreams = append(upstreams, target)
+	}
+
+	upstream := NewProxyTarget(NewProxyConfig(upstreams[0], ""))
+	h := ApplyProxyOptions(proxyFor(upstream))
+	checker := upstreamHealthChecker{upstream}
+
+	stop := make(chan struct{})
+	swapped := make(chan struct{})
+	go func() {
+		defer close(swapped)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			upstream.Swap(NewProxyConfig(upstreams[i%2], ""))
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+				if w.Code != http.StatusOK {
+					t.Errorf("status = %d, request mixed configs", w.Code)
+				}
+				if err := checker.Check(context.Background()); err != nil {
+					t.Error(err)
+				}
+				if label := upstream.Label(); label != upstreams[0].Host && label != upstreams[1].Host {
+					t.Errorf("label = %q", label)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-swapped
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Method policy of responses generated by the proxy itself, like static files or admin API.
+// Answers OPTIONS with 204, and other methods not in the list with 405, both with Allow
+// header listing allowed methods. HEAD is allowed with GET, and its body is dropped by
+// net/http, keeping Content-Length. Returns false if request was answered.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	allowed := false
+	for _, method := range methods {
+		if r.Method == method || (r.Method == http.MethodHead && method == http.MethodGet) {
+			allowed = true
+		}
+	}
+	if allowed {
+		return true
+	}
+
+	allow := make([]string, 0, len(methods)+2)
+	for _, method := range methods {
+		allow = append(allow, method)
+		if method == http.MethodGet {
+			allow = append(allow, http.MethodHead)
+		}
+	}
+	w.Header().Set("Allow", strings.Join(append(allow, http.MethodOptions), ", "))
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return false
+	}
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
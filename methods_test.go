@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func methodRequest(t *testing.T, method, url string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, body
+}
+
+// Every responder of the proxy itself answers HEAD, OPTIONS and unsupported methods the same way
+func TestLocalResponderMethods(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "robots.txt"), []byte("User-agent: *\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	static := Chain(http.NotFoundHandler(), StaticFiles(dir, "/static/", time.Hour))
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		path    string
+		allow   string
+	}{
+		{"routes", http.HandlerFunc(routesHandler), "/__proxy/routes", "GET, HEAD, OPTIONS"},
+		{"plugin inventory", http.HandlerFunc(pluginInventoryHandler), "/__proxy/plugins", "GET, HEAD, OPTIONS"},
+		{"lifecycle", lifecycle, "/__proxy/lifecycle", "GET, HEAD, OPTIONS"},
+		{"readiness", ReadyHandler(""), "/readyz", "GET, HEAD, OPTIONS"},
+		{"expvar", http.HandlerFunc(varsHandler), "/debug/vars", "GET, HEAD, OPTIONS"},
+		{"feature flags", http.HandlerFunc(featureFlagsHandler), featureFlagsAdminPath, "GET, HEAD, OPTIONS"},
+		{"feature flag", http.HandlerFunc(featureFlagsHandler), featureFlagsAdminPath + "/beta", "PUT, OPTIONS"},
+		{"archive", http.HandlerFunc(archiveHandler), archiveAdminPath, "GET, HEAD, POST, OPTIONS"},
+		{"static files", static, "/static/robots.txt", "GET, HEAD, OPTIONS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			getResp, getBody := methodRequest(t, http.MethodGet, server.URL+tt.path)
+			headResp, headBody := methodRequest(t, http.MethodHead, server.URL+tt.path)
+			if len(headBody) != 0 {
+				t.Errorf("HEAD body = %q, want none", headBody)
+			}
+			if headResp.StatusCode != getResp.StatusCode {
+				t.Errorf("HEAD status = %d, GET status = %d", headResp.StatusCode, getResp.StatusCode)
+			}
+			// Large bodies are sent chunked, without Content-Length
+			if headResp.ContentLength != getResp.ContentLength {
+				t.Errorf("HEAD Content-Length = %d, GET Content-Length = %d", headResp.ContentLength, getResp.ContentLength)
+			}
+			if getResp.ContentLength >= 0 && getResp.ContentLength != int64(len(getBody)) {
+				t.Errorf("GET Content-Length = %d, body is %d bytes", getResp.ContentLength, len(getBody))
+			}
+
+			resp, body := methodRequest(t, http.MethodOptions, server.URL+tt.path)
+			if resp.StatusCode != http.StatusNoContent || len(body) != 0 || resp.Header.Get("Allow") != tt.allow {
+				t.Errorf("OPTIONS: status %d, Allow %q, want 204 and %q", resp.StatusCode, resp.Header.Get("Allow"), tt.allow)
+			}
+
+			resp, _ = methodRequest(t, http.MethodDelete, server.URL+tt.path)
+			if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != tt.allow {
+				t.Errorf("DELETE: status %d, Allow %q, want 405 and %q", resp.StatusCode, resp.Header.Get("Allow"), tt.allow)
+			}
+		})
+	}
+}
+
+func TestSyntheticUpstreamHead(t *testing.T) {
+	target, _ := url.Parse("synthetic://test?size=100")
+	h := ApplyProxyOptions(httputil.NewSingleHostReverseProxy(target), SyntheticUpstream(target))
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	resp, body := methodRequest(t, http.MethodHead, server.URL)
+	if resp.StatusCode != http.StatusOK || len(body) != 0 || resp.ContentLength != 100 {
+		t.Errorf("HEAD: status %d, %d body bytes, Content-Length %d, want 200, none and 100", resp.StatusCode, len(body), resp.ContentLength)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"expvar"
+	"time"
+)
+
+// Counts observed durations in buckets by upper bound, exported as expvar map.
+// Durations above the last bucket are counted as "inf".
+type histogram struct {
+	buckets []time.Duration
+	counts  *expvar.Map
+}
+
+func newHistogram(name string, buckets ...time.Duration) *histogram {
+	return &histogram{buckets: buckets, counts: expvar.NewMap(name)}
+}
+
+func (h *histogram) Observe(d time.Duration) {
+	for _, bucket := range h.buckets {
+		if d <= bucket {
+			h.counts.Add(bucket.String(), 1)
+			return
+		}
+	}
+	h.counts.Add("inf", 1)
+}
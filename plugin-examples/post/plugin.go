@@ -9,8 +9,9 @@ import (
 func Middleware(h http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         log.Println("Running POST plugin")
-        if user := r.Context().Value("Username"); user != nil {
-            r.Header.Set("Username", r.Context().Value("Username").(string))
+        // Checked type assertion, so unexpected value does not panic inside the chain
+        if user, ok := r.Context().Value("Username").(string); ok {
+            r.Header.Set("Username", user)
         }
 
         h.ServeHTTP(w, r)
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"plugin"
+	"reflect"
+	"time"
+)
+
+var (
+	pluginInitTimeout time.Duration
+	// Continue without plugins which fail to initialize, instead of failing startup
+	pluginOptional bool
+)
+
+// Opens plugin and runs its optional `Init() error` function. Package init functions
+// run by plugin.Open are covered by the timeout too. Go can't interrupt a blocked
+// function, so after timeout it is left running in background.
+func initPlugin(path string) error {
+	done := make(chan error, 1)
+	go func() {
+		p, err := plugin.Open(path)
+		if err != nil {
+			done <- err
+			return
+		}
+
+		symbol, err := p.Lookup("Init")
+		if err != nil {
+			// Init is optional
+			done <- nil
+			return
+		}
+		initialize, ok := symbol.(func() error)
+		if !ok {
+			done <- fmt.Errorf("'Init' function should have `func() error` type, got `%s`", reflect.TypeOf(symbol))
+			return
+		}
+		done <- initialize()
+	}()
+
+	if pluginInitTimeout <= 0 {
+		return <-done
+	}
+
+	timer := time.NewTimer(pluginInitTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return fmt.Errorf("initialization did not finish in %s", pluginInitTimeout)
+	}
+}
+
+// Initializes plugins one by one, in the order they are passed, so the log shows
+// which plugin startup waits for. Init durations and errors are kept in plugin inventory.
+func InitPlugins(paths ...string) {
+	var pending []string
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if path != "" && !seen[path] {
+			seen[path] = true
+			pending = append(pending, path)
+		}
+	}
+
+	for i, path := range pending {
+		log.Printf("Initializing %s (%d/%d)...", path, i+1, len(pending))
+
+		start := time.Now()
+		err := initPlugin(path)
+		duration := time.Since(start)
+
+		pluginInventory.Lock()
+		info := pluginEntry(path)
+		info.InitDuration = duration
+		if err != nil {
+			info.InitError = err.Error()
+		}
+		pluginInventory.Unlock()
+
+		if err == nil {
+			log.Printf("Initialized %s in %s", path, duration)
+			continue
+		}
+		if !pluginOptional {
+			log.Fatalf("Plugin %s failed to initialize: %v", path, err)
+		}
+		log.Printf("Plugin %s failed to initialize, continuing without it: %v", path, err)
+	}
+}
+
+// Reports plugins skipped because of -plugin-optional
+func pluginSkipped(path string) bool {
+	pluginInventory.Lock()
+	defer pluginInventory.Unlock()
+
+	for _, info := range pluginInventory.plugins {
+		if info.Path == path {
+			return info.InitError != ""
+		}
+	}
+	return false
+}
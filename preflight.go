@@ -0,0 +1,167 @@
+package main
+
+import (
+	"debug/elf"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"plugin"
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Fail startup on preflight problems, instead of logging them
+var strictPlugins bool
+
+// Checks plugin exports once, before host looks up its hooks, so misspelled or
+// mistyped hooks are reported before a failing lookup stops the proxy.
+func preflight(path string) {
+	pluginInventory.Lock()
+	defer pluginInventory.Unlock()
+	checkPluginExports(pluginEntry(path))
+}
+
+// Checks plugin exports, unless already checked. Problems are logged,
+// or stop the proxy with -strict-plugins. Caller holds inventory lock.
+func checkPluginExports(info *PluginInfo) {
+	if info.preflighted {
+		return
+	}
+	info.preflighted = true
+
+	hooks, problems, err := preflightPlugin(info.Path)
+	if err != nil {
+		log.Print("Can't preflight plugin ", info.Path, " ", err)
+		return
+	}
+
+	for _, problem := range problems {
+		if strictPlugins {
+			log.Fatal("Plugin ", info.Path, ": ", problem)
+		}
+		log.Print("Plugin ", info.Path, ": ", problem)
+	}
+	info.Exports = hooks
+	info.Problems = problems
+}
+
+type hookSpec struct {
+	name string
+	typ  reflect.Type
+}
+
+// Every symbol the host looks up in plugins, and its expected type
+var hookCatalog = []hookSpec{
+	{"Middleware", reflect.TypeOf((func(http.Handler) http.Handler)(nil))},
+	{"AdminRoutes", reflect.TypeOf((func() map[string]http.HandlerFunc)(nil))},
+	{"Proxy", reflect.TypeOf((func(*url.URL, string) http.Handler)(nil))},
+	{"Init", reflect.TypeOf((func() error)(nil))},
+}
+
+// Lists exported symbols of the plugin. Go plugin package can't enumerate them,
+// so candidates are read from ELF dynamic symbols, and confirmed with Lookup.
+func pluginExports(p *plugin.Plugin, path string) ([]string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	symbols, err := f.DynamicSymbols()
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var exports []string
+	for _, sym := range symbols {
+		ident := sym.Name[strings.LastIndexByte(sym.Name, '.')+1:]
+		first, _ := utf8.DecodeRuneInString(ident)
+		if !unicode.IsUpper(first) || strings.ContainsRune(ident, '·') || seen[ident] {
+			continue
+		}
+		seen[ident] = true
+
+		if _, err := p.Lookup(ident); err == nil {
+			exports = append(exports, ident)
+		}
+	}
+	return exports, nil
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// Returns hook which name looks misspelled as given export name. Short names are
+// compared ignoring case only, as one or two edits turn them into ordinary words,
+// e.g. Init into Unit or Info.
+func misspelledHook(name string) (string, bool) {
+	for _, hook := range hookCatalog {
+		maxDistance := 2
+		if len(hook.name) < 6 {
+			maxDistance = 0
+		}
+		if strings.EqualFold(name, hook.name) || editDistance(name, hook.name) <= maxDistance {
+			return hook.name, true
+		}
+	}
+	return "", false
+}
+
+// Matches plugin exports against hook catalog, and returns hooks it contributes,
+// and problems: exports with wrong type, and misspelled hook names.
+func preflightPlugin(path string) ([]string, []string, error) {
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	exports, err := pluginExports(p, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var hooks, problems []string
+	for _, name := range exports {
+		matched := false
+		for _, hook := range hookCatalog {
+			if name == hook.name {
+				matched = true
+				symbol, _ := p.Lookup(name)
+				if typ := reflect.TypeOf(symbol); typ != hook.typ {
+					problems = append(problems, fmt.Sprintf("'%s' has `%s` type, expected `%s`", name, typ, hook.typ))
+				} else {
+					hooks = append(hooks, name)
+				}
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+
+		if hook, ok := misspelledHook(name); ok {
+			problems = append(problems, fmt.Sprintf("found '%s', did you mean '%s'?", name, hook))
+		}
+	}
+	return hooks, problems, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestMisspelledHook(t *testing.T) {
+	tests := []struct {
+		name string
+		hook string
+	}{
+		{"Middlware", "Middleware"},
+		{"MiddleWare", "Middleware"},
+		{"middleware", "Middleware"},
+		{"Adminroutes", "AdminRoutes"},
+		{"AdminRoute", "AdminRoutes"},
+		{"init", "Init"},
+		{"INIT", "Init"},
+		{"proxy", "Proxy"},
+		// Ordinary names close to short hooks
+		{"Info", ""},
+		{"Exit", ""},
+		{"List", ""},
+		{"Unit", ""},
+		{"Prox", ""},
+		{"Handler", ""},
+		{"Version", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hook, ok := misspelledHook(tt.name)
+			if hook != tt.hook || ok != (tt.hook != "") {
+				t.Errorf("misspelledHook(%q) = %q, %v, want %q", tt.name, hook, ok, tt.hook)
+			}
+		})
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"Init", "Init", 0},
+		{"Init", "Unit", 1},
+		{"Init", "Info", 2},
+		{"Middlware", "Middleware", 1},
+		{"", "Proxy", 5},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Package protocol describes protocols a request came and went with. The proxy stores
+// it in request context, and plugins import it to read it.
+package protocol
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"strings"
+)
+
+// Protocol details of a request. Upstream is set once upstream responded.
+type Info struct {
+	// "h1", "h2" or "h3"
+	Inbound string
+	// Requested protocol of upgrade request, e.g. "websocket", empty otherwise
+	Upgrade string
+	// Empty for plain HTTP connections
+	TLSVersion string
+	TLSCipher  string
+	// Protocol of upstream response, e.g. "HTTP/1.1"
+	Upstream string
+}
+
+func Of(r *http.Request) *Info {
+	info := &Info{}
+	info.Read(r)
+	return info
+}
+
+// Sets inbound protocol, upgrade and TLS details from request. Upstream is left as is.
+func (info *Info) Read(r *http.Request) {
+	info.Inbound = "h1"
+	switch r.ProtoMajor {
+	case 2:
+		info.Inbound = "h2"
+	case 3:
+		info.Inbound = "h3"
+	}
+
+	info.Upgrade = ""
+	for _, token := range r.Header.Values("Connection") {
+		for token != "" {
+			var option string
+			option, token, _ = strings.Cut(token, ",")
+			if strings.EqualFold(strings.TrimSpace(option), "upgrade") {
+				info.Upgrade = strings.ToLower(r.Header.Get("Upgrade"))
+			}
+		}
+	}
+
+	info.TLSVersion, info.TLSCipher = "", ""
+	if r.TLS != nil {
+		info.TLSVersion = tls.VersionName(r.TLS.Version)
+		info.TLSCipher = tls.CipherSuiteName(r.TLS.CipherSuite)
+	}
+}
+
+type contextKey struct{}
+
+// Reports whether key is the key of protocol details in request context, for contexts carrying
+// several values in one layer, like the proxy's own request state. Value under the key should be *Info.
+func IsContextKey(key interface{}) bool {
+	_, ok := key.(contextKey)
+	return ok
+}
+
+func NewContext(ctx context.Context, info *Info) context.Context {
+	return context.WithValue(ctx, contextKey{}, info)
+}
+
+// Returns nil if request went through no protocol labeling
+func FromContext(ctx context.Context) *Info {
+	info, _ := ctx.Value(contextKey{}).(*Info)
+	return info
+}
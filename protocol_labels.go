@@ -0,0 +1,59 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/TykTechnologies/go-plugins-template/protocol"
+)
+
+// Keys are protocol names only, never header values, so cardinality stays bounded
+var (
+	requestsByProtocol          = expvar.NewMap("requests_by_protocol")
+	upstreamResponsesByProtocol = expvar.NewMap("upstream_responses_by_protocol")
+)
+
+// Labels request with inbound protocol, upgrade and TLS details, for access log,
+// metrics and plugins. Should be placed before access log.
+func ProtocolLabels() Middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var info *protocol.Info
+			if state := requestStateOf(r); state != nil {
+				state.protocol.Read(r)
+				state.hasProtocol = true
+				info = &state.protocol
+			} else {
+				info = protocol.Of(r)
+				r = r.WithContext(protocol.NewContext(r.Context(), info))
+			}
+
+			label := info.Inbound
+			if info.Upgrade != "" {
+				label += "-upgrade"
+			}
+			requestsByProtocol.Add(label, 1)
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Records protocol upstream responded with
+func UpstreamProtocolLabel() ProxyOption {
+	return func(proxy *httputil.ReverseProxy) {
+		appendModifyResponse(proxy, func(resp *http.Response) error {
+			label := "h1"
+			if resp.ProtoMajor == 2 {
+				label = "h2"
+			}
+			upstreamResponsesByProtocol.Add(label, 1)
+
+			if info := protocol.FromContext(resp.Request.Context()); info != nil {
+				info.Upstream = resp.Proto
+			}
+			return nil
+		})
+	}
+}
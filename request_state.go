@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/TykTechnologies/go-plugins-template/protocol"
+	"github.com/TykTechnologies/go-plugins-template/trail"
+)
+
+// Values built-in middlewares keep for every request: decision trail, protocol labels and
+// access log record. Allocated at once and stored in a single context layer, instead of
+// a context layer, request copy and allocation per value. Values are still read with
+// usual context keys, e.g. trail.FromContext, so plugins do not see the difference.
+type requestState struct {
+	context.Context
+	trail trail.Trail
+
+	hasProtocol bool
+	protocol    protocol.Info
+
+	// Pooled by access log, nil once request is logged
+	accessLog *accessLogRecord
+}
+
+type requestStateContextKey struct{}
+
+func (s *requestState) Value(key interface{}) interface{} {
+	switch {
+	case trail.IsContextKey(key):
+		return &s.trail
+	case protocol.IsContextKey(key):
+		if s.hasProtocol {
+			return &s.protocol
+		}
+	case key == accessLogContextKey{}:
+		if s.accessLog != nil {
+			return s.accessLog
+		}
+	case key == requestStateContextKey{}:
+		return s
+	}
+	return s.Context.Value(key)
+}
+
+// Returns nil if request went through no DecisionTrail
+func requestStateOf(r *http.Request) *requestState {
+	state, _ := r.Context().Value(requestStateContextKey{}).(*requestState)
+	return state
+}
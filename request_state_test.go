@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/TykTechnologies/go-plugins-template/protocol"
+	"github.com/TykTechnologies/go-plugins-template/trail"
+)
+
+type testContextKey struct{}
+
+func TestRequestState(t *testing.T) {
+	var gotTrail *trail.Trail
+	var gotProtocol *protocol.Info
+	var gotParent interface{}
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recordDecision(r, "test", decisionAllow, "reached")
+		gotTrail = trail.FromContext(r.Context())
+		gotProtocol = protocol.FromContext(r.Context())
+		gotParent = r.Context().Value(testContextKey{})
+	}), DecisionTrail(), ProtocolLabels())
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), testContextKey{}, "parent"))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if entries := gotTrail.Entries(); len(entries) != 1 || entries[0].Detail != "reached" {
+		t.Errorf("trail entries = %v", entries)
+	}
+	if gotProtocol == nil || gotProtocol.Inbound != "h1" {
+		t.Errorf("protocol = %+v, want h1", gotProtocol)
+	}
+	if gotParent != "parent" {
+		t.Errorf("parent context value = %v", gotParent)
+	}
+}
+
+// Default chain, as main builds it without plugins
+func BenchmarkChain(b *testing.B) {
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}),
+		DecisionTrail(),
+		StrictRequests(true, ""),
+		ProtocolLabels(),
+		AccessLog(os.DevNull, AccessLogJSON, "", nil),
+		AccessLogCapture(),
+	)
+	r := httptest.NewRequest("GET", "/a?b=c", nil)
+	w := httptest.NewRecorder()
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(w, r)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// Headers which frame the response body, filtering them breaks the response
+var framingHeaders = map[string]bool{
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Trailer":           true,
+}
+
+// Splits comma separated flag value, skipping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func headerSet(value string) map[string]bool {
+	set := make(map[string]bool)
+	for _, name := range splitList(value) {
+		set[http.CanonicalHeaderKey(name)] = true
+	}
+	return set
+}
+
+// Removed upstream response headers and trailers by name, every value counted,
+// as headers like Set-Cookie are sent as separate lines
+var filteredResponseHeaders = expvar.NewMap("filtered_response_headers")
+
+// Removes upstream response headers and trailers before they reach the client. If allow list
+// is set, only listed headers pass. Deny list is applied on top of it.
+// Runs after ModifyResponse already defined on the proxy, so headers added
+// there are subject to the same policy.
+func ResponseHeaderFilter(allow, deny, exposePrefix string) ProxyOption {
+	allowed := headerSet(allow)
+	denied := headerSet(deny)
+	if len(allowed) == 0 && len(denied) == 0 {
+		return nil
+	}
+	exposePrefix = http.CanonicalHeaderKey(exposePrefix)
+
+	keep := func(name string) bool {
+		if framingHeaders[name] || (exposePrefix != "" && strings.HasPrefix(name, exposePrefix)) {
+			return true
+		}
+		if len(allowed) > 0 && !allowed[name] {
+			return false
+		}
+		return !denied[name]
+	}
+	filter := func(header http.Header) {
+		for name, values := range header {
+			if !keep(name) {
+				filteredResponseHeaders.Add(name, int64(len(values)))
+				delete(header, name)
+			}
+		}
+	}
+
+	return func(proxy *httputil.ReverseProxy) {
+		appendModifyResponse(proxy, func(resp *http.Response) error {
+			filter(resp.Header)
+
+			// Announced trailers are listed before the body, and removed ones should not be
+			if announced := resp.Header.Values("Trailer"); len(announced) > 0 {
+				var kept []string
+				for _, name := range splitList(strings.Join(announced, ",")) {
+					if keep(http.CanonicalHeaderKey(name)) {
+						kept = append(kept, name)
+					}
+				}
+				resp.Header.Del("Trailer")
+				if len(kept) > 0 {
+					resp.Header.Set("Trailer", strings.Join(kept, ", "))
+				}
+			}
+			for name := range resp.Trailer {
+				if !keep(name) {
+					delete(resp.Trailer, name)
+				}
+			}
+			if resp.Body != nil && resp.Body != http.NoBody {
+				resp.Body = &trailerFilterBody{ReadCloser: resp.Body, resp: resp, filter: filter}
+			}
+			return nil
+		})
+	}
+}
+
+// Filters trailers once upstream body is read, as their values, and trailers upstream
+// did not announce, are known only then
+type trailerFilterBody struct {
+	io.ReadCloser
+	resp   *http.Response
+	filter func(http.Header)
+}
+
+func (b *trailerFilterBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.filter(b.resp.Trailer)
+	}
+	return n, err
+}
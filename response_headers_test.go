@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+)
+
+func TestResponseHeaderFilter(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend-Node", "node-7")
+		w.Header().Set("X-Plugin-Hint", "kept")
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.Header().Set("Trailer", "X-Internal-Trace, X-Checksum")
+		io.WriteString(w, "body")
+		w.Header().Set("X-Internal-Trace", "trace")
+		w.Header().Set("X-Checksum", "abc")
+		// Not announced, known only after the body
+		w.Header().Set(http.TrailerPrefix+"X-Backend-Node", "node-7")
+	}))
+	defer upstream.Close()
+
+	target, _ := url.Parse(upstream.URL)
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ErrorLog = log.New(io.Discard, "", 0)
+	h := ApplyProxyOptions(proxy, ResponseHeaderFilter("", "X-Backend-Node, X-Internal-Trace,Set-Cookie,X-Plugin-Hint", "X-Plugin-"))
+	front := httptest.NewServer(h)
+	defer front.Close()
+
+	node := expvarInt(filteredResponseHeaders.Get("X-Backend-Node"))
+	cookies := expvarInt(filteredResponseHeaders.Get("Set-Cookie"))
+
+	resp, err := http.Get(front.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// Trailers are known only after the body
+	if _, found := resp.Trailer["X-Internal-Trace"]; found {
+		t.Errorf("denied trailer is announced, trailer %v", resp.Trailer)
+	}
+	body, _ := io.ReadAll(resp.Body)
+
+	if string(body) != "body" {
+		t.Errorf("body %q", body)
+	}
+	for _, name := range []string{"X-Backend-Node", "Set-Cookie"} {
+		if values := resp.Header.Values(name); len(values) > 0 {
+			t.Errorf("header %s is not filtered: %v", name, values)
+		}
+	}
+	if resp.Header.Get("X-Plugin-Hint") != "kept" {
+		t.Error("header with expose prefix is filtered")
+	}
+	for _, name := range []string{"X-Backend-Node", "X-Internal-Trace"} {
+		if value := resp.Trailer.Get(name); value != "" {
+			t.Errorf("trailer %s is not filtered: %q", name, value)
+		}
+	}
+	if resp.Trailer.Get("X-Checksum") != "abc" {
+		t.Errorf("allowed trailer is lost, trailer %v", resp.Trailer)
+	}
+
+	// Header and trailer of the same name are counted separately, and every Set-Cookie line
+	if got := expvarInt(filteredResponseHeaders.Get("X-Backend-Node")) - node; got != 2 {
+		t.Errorf("X-Backend-Node filtered %d times, want 2", got)
+	}
+	if got := expvarInt(filteredResponseHeaders.Get("Set-Cookie")) - cookies; got != 2 {
+		t.Errorf("Set-Cookie filtered %d times, want 2", got)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+
+	"github.com/TykTechnologies/go-plugins-template/upstreamerr"
+)
+
+var truncatedResponses = expvar.NewInt("truncated_responses")
+
+var errResponseTooLarge = upstreamerr.ErrResponseTooLarge
+
+// Fails reading once more than limit bytes were read. Proxy aborts
+// the client connection on read error, since headers are already sent.
+type limitedBody struct {
+	io.ReadCloser
+	path  string
+	limit int64
+	read  int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.read > b.limit {
+		return 0, errResponseTooLarge
+	}
+
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if b.read > b.limit {
+		truncatedResponses.Add(1)
+		log.Println("Upstream response exceeds max size, aborting", b.path, b.read, b.limit)
+		return n - int(b.read-b.limit), errResponseTooLarge
+	}
+	return n, err
+}
+
+// Limits upstream response body size. Responses with too large Content-Length
+// are replaced with 502, streamed ones are cut when the limit is reached.
+// Upstream paths starting with one of exclude prefixes are not limited.
+func MaxResponseSize(limit int64, exclude string) ProxyOption {
+	if limit <= 0 {
+		return nil
+	}
+	excluded := splitList(exclude)
+
+	return func(proxy *httputil.ReverseProxy) {
+		appendModifyResponse(proxy, func(resp *http.Response) error {
+			path := resp.Request.URL.Path
+			for _, prefix := range excluded {
+				if strings.HasPrefix(path, prefix) {
+					return nil
+				}
+			}
+
+			if resp.ContentLength > limit {
+				truncatedResponses.Add(1)
+				return fmt.Errorf("%w: %s %d bytes", errResponseTooLarge, path, resp.ContentLength)
+			}
+
+			resp.Body = &limitedBody{ReadCloser: resp.Body, path: path, limit: limit}
+			return nil
+		})
+	}
+}
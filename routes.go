@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// Describes what proxy serves under a path, for /__proxy/routes admin endpoint.
+// Should never contain secrets, like passwords or credentials in target URL.
+type RouteInfo struct {
+	Match   string            `json:"match"`
+	Target  string            `json:"target"`
+	Rewrite string            `json:"rewrite,omitempty"`
+	Auth    []string          `json:"auth"`
+	Plugins []string          `json:"plugins"`
+	Limits  map[string]string `json:"limits,omitempty"`
+
+	// Target is read from it when set, so it follows config swaps
+	upstream *ProxyTarget
+}
+
+var routeTable struct {
+	sync.Mutex
+	routes []RouteInfo
+	// What happens with requests no route matches
+	unmatched string
+}
+
+// Routes are listed in the order they are matched
+func RegisterRoute(route RouteInfo) {
+	routeTable.Lock()
+	defer routeTable.Unlock()
+	routeTable.routes = append(routeTable.routes, route)
+}
+
+func SetUnmatchedRoutePolicy(policy string) {
+	routeTable.Lock()
+	defer routeTable.Unlock()
+	routeTable.unmatched = policy
+}
+
+func routesHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	routeTable.Lock()
+	defer routeTable.Unlock()
+
+	routes := make([]RouteInfo, len(routeTable.routes))
+	for i, route := range routeTable.routes {
+		if route.upstream != nil {
+			route.Target = route.upstream.Load().Target.Redacted()
+		}
+		routes[i] = route
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"routes":    routes,
+		"unmatched": routeTable.unmatched,
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"unicode/utf8"
+)
+
+// Longest request derived value written into headers and log fields
+const maxDerivedValueSize = 1024
+
+func isControl(c byte) bool {
+	return c < 0x20 || c == 0x7f
+}
+
+// Cuts value to maxDerivedValueSize bytes, on a character boundary
+func truncateValue(b []byte) []byte {
+	if len(b) <= maxDerivedValueSize {
+		return b
+	}
+	n := maxDerivedValueSize
+	for n > 0 && !utf8.RuneStart(b[n]) {
+		n--
+	}
+	return b[:n]
+}
+
+// Makes request derived value, like client supplied credentials or origin, safe to write
+// into headers: control characters, including CR, LF and NUL, are removed, so value can't
+// inject headers, and long values are cut to maxDerivedValueSize bytes.
+// Every header value derived from request data should go through it.
+func sanitizeValue(s string) string {
+	clean := len(s) <= maxDerivedValueSize
+	for i := 0; clean && i < len(s); i++ {
+		clean = !isControl(s[i])
+	}
+	if clean {
+		return s
+	}
+
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if !isControl(s[i]) {
+			b = append(b, s[i])
+		}
+	}
+	return string(truncateValue(b))
+}
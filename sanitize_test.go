@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSanitizeValue(t *testing.T) {
+	long := strings.Repeat("a", maxDerivedValueSize)
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"clean", "alice", "alice"},
+		{"empty", "", ""},
+		{"CRLF injection", "alice\r\nSet-Cookie: a=b", "aliceSet-Cookie: a=b"},
+		{"bare LF", "a\nb", "ab"},
+		{"NUL", "a\x00b", "ab"},
+		{"DEL and tab", "a\x7fb\tc", "abc"},
+		{"multibyte kept", "zoë ☃", "zoë ☃"},
+		{"at limit", long, long},
+		{"over limit", long + "bc", long},
+		// Cut falls inside the 3 bytes of ☃, which is dropped whole
+		{"over limit inside character", long[:maxDerivedValueSize-1] + "☃", long[:maxDerivedValueSize-1]},
+		{"control characters before cut", "\r\n" + long + "x", long},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := sanitizeValue(tt.value)
+			if got != tt.want {
+				t.Errorf("sanitizeValue() = %.40q (%d bytes), want %.40q (%d bytes)", got, len(got), tt.want, len(tt.want))
+			}
+			if !utf8.ValidString(got) && utf8.ValidString(tt.value) {
+				t.Errorf("sanitizeValue() cut a character: %q", got[len(got)-4:])
+			}
+		})
+	}
+}
+
+func TestTruncateValue(t *testing.T) {
+	// Every cut position inside a 4 byte character
+	for offset := 1; offset <= 4; offset++ {
+		value := strings.Repeat("a", maxDerivedValueSize-offset) + "𝄞" + "tail"
+		got := truncateValue([]byte(value))
+		if len(got) > maxDerivedValueSize || !utf8.Valid(got) {
+			t.Errorf("offset %d: %d bytes, valid %v", offset, len(got), utf8.Valid(got))
+		}
+		// Character ending right at the limit is kept
+		want := maxDerivedValueSize - offset
+		if offset == 4 {
+			want = maxDerivedValueSize
+		}
+		if len(got) != want {
+			t.Errorf("offset %d: %d bytes, want %d", offset, len(got), want)
+		}
+	}
+}
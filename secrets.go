@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var secretRotations = expvar.NewMap("secret_rotations")
+
+// How long previous value of rotated secret stays accepted by consumers supporting it
+var secretRotationOverlap time.Duration
+
+// Secret loaded from `env:<VARIABLE>`, `file:<path>` or inline value. File backed secrets
+// are reloaded by WatchSecrets. Value is never logged, only name and source.
+type Secret struct {
+	name   string
+	source string
+	path   string
+
+	mu        sync.RWMutex
+	value     string
+	previous  string
+	rotatedAt time.Time
+	modTime   time.Time
+	consumers []func(value string)
+}
+
+var secrets struct {
+	sync.Mutex
+	list []*Secret
+}
+
+func readSecretFile(path string) (string, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	// Editors and `echo` add trailing newline
+	value := strings.TrimRight(string(data), "\r\n")
+	if value == "" {
+		return "", time.Time{}, errors.New("file is empty")
+	}
+	return value, info.ModTime(), nil
+}
+
+// Loads secret by reference, returns nil if reference is empty
+func LoadSecret(name, ref string) *Secret {
+	if ref == "" {
+		return nil
+	}
+
+	s := &Secret{name: name, source: "inline", value: ref}
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		s.source = ref
+		s.value = os.Getenv(strings.TrimPrefix(ref, "env:"))
+		if s.value == "" {
+			log.Fatal("Secret ", name, " is empty, environment variable is not set ", ref)
+		}
+	case strings.HasPrefix(ref, "file:"):
+		s.source = ref
+		s.path = strings.TrimPrefix(ref, "file:")
+		var err error
+		if s.value, s.modTime, err = readSecretFile(s.path); err != nil {
+			log.Fatal("Can't load secret ", name, " from ", ref, " ", err)
+		}
+	}
+
+	secrets.Lock()
+	secrets.list = append(secrets.list, s)
+	secrets.Unlock()
+	return s
+}
+
+func (s *Secret) Value() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.value
+}
+
+// Compares candidate with current value, and with previous one during rotation overlap.
+// Takes the same time whether candidate matches or not.
+func (s *Secret) Matches(candidate string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	match := subtle.ConstantTimeCompare([]byte(candidate), []byte(s.value))
+	if s.previous != "" && time.Since(s.rotatedAt) < secretRotationOverlap {
+		match |= subtle.ConstantTimeCompare([]byte(candidate), []byte(s.previous))
+	}
+	return match == 1
+}
+
+// Registers consumer called with new value after rotation, e.g. to rebuild a signer
+func (s *Secret) OnRotate(fn func(value string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.consumers = append(s.consumers, fn)
+}
+
+// Reloads file backed secret if file changed. Invalid new value is rejected,
+// and the current one stays in use.
+func (s *Secret) reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	changed := !info.ModTime().Equal(s.modTime)
+	s.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+
+	value, _, err := readSecretFile(s.path)
+	s.mu.Lock()
+	// Invalid file is reported once, not on every check
+	s.modTime = info.ModTime()
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	if value == s.value {
+		s.mu.Unlock()
+		return nil
+	}
+	s.previous, s.value, s.rotatedAt = s.value, value, time.Now()
+	consumers := s.consumers
+	s.mu.Unlock()
+
+	secretRotations.Add(s.name, 1)
+	log.Printf("Secret %s rotated from %s, previous value accepted for %s", s.name, s.source, secretRotationOverlap)
+	for _, consumer := range consumers {
+		consumer(value)
+	}
+	return nil
+}
+
+// Checks file backed secrets for changes every interval
+func WatchSecrets(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			secrets.Lock()
+			list := secrets.list
+			secrets.Unlock()
+
+			for _, s := range list {
+				if s.path == "" {
+					continue
+				}
+				if err := s.reload(); err != nil {
+					log.Printf("Can't reload secret %s from %s, keeping current value: %v", s.name, s.source, err)
+				}
+			}
+		}
+	}()
+}
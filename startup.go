@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// Handler of the proxy listeners. Answers 503 until the chain is fully constructed,
+// so listeners bound early never pass requests into a partially built chain.
+type startupGate struct {
+	handler atomic.Pointer[http.Handler]
+}
+
+func (g *startupGate) Set(h http.Handler) {
+	g.handler.Store(&h)
+}
+
+func (g *startupGate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h := g.handler.Load(); h != nil {
+		(*h).ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Retry-After", "1")
+	http.Error(w, "Service Unavailable: proxy is starting", http.StatusServiceUnavailable)
+}
+
+// Binds listeners and starts serving them. Returned channel receives the first
+// serving error, or nil once all listeners are closed by shutdown.
+func ServeListeners(server *http.Server, addresses string, scanHeads bool) <-chan error {
+	listeners, err := Listen(addresses)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var bound []string
+	for _, listener := range listeners {
+		bound = append(bound, listener.Addr().String())
+	}
+	lifecycle.Emit(phaseListenerBound, map[string][]string{"addresses": bound})
+
+	if scanHeads {
+		ScanRequestHeads(listeners, server)
+	}
+
+	served := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			served <- server.Serve(listener)
+		}(listener)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		for range listeners {
+			if err := <-served; err != http.ErrServerClosed {
+				result <- err
+				return
+			}
+		}
+		result <- nil
+	}()
+	return result
+}
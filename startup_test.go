@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStartupGate(t *testing.T) {
+	gate := &startupGate{}
+	server := httptest.NewServer(gate)
+	defer server.Close()
+
+	get := func() (int, string) {
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Error(err)
+			return 0, ""
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, resp.Header.Get("Retry-After")
+	}
+
+	if status, retry := get(); status != http.StatusServiceUnavailable || retry != "1" {
+		t.Errorf("before Set: status %d, Retry-After %q, want 503 and 1", status, retry)
+	}
+
+	// Requests racing with Set either wait out with 503 or reach the chain, never anything else
+	var served int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if status, _ := get(); status != http.StatusServiceUnavailable && status != http.StatusNoContent {
+				t.Errorf("during Set: status %d", status)
+			}
+		}()
+	}
+	gate.Set(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&served, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	wg.Wait()
+
+	before := atomic.LoadInt64(&served)
+	if status, _ := get(); status != http.StatusNoContent {
+		t.Errorf("after Set: status %d, want 204", status)
+	}
+	if atomic.LoadInt64(&served) != before+1 {
+		t.Errorf("after Set: request did not reach the chain")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// File system which hides dot files, and directories without index.html,
+// so static folder can't be listed
+type staticFS struct {
+	http.FileSystem
+}
+
+func (sfs staticFS) Open(name string) (http.File, error) {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, ".") {
+			return nil, fs.ErrNotExist
+		}
+	}
+
+	f, err := sfs.FileSystem.Open(name)
+	if err != nil {
+		// Includes attempts to escape static folder through symlinks
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Println("Can't open static file", name, err)
+		}
+		return nil, fs.ErrNotExist
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if stat.IsDir() {
+		index, err := sfs.FileSystem.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, fs.ErrNotExist
+		}
+		index.Close()
+	}
+
+	return f, nil
+}
+
+// Sets Cache-Control on successful responses only, as file server keeps
+// headers set before it on errors, and 404 should not be cached
+type staticCacheWriter struct {
+	http.ResponseWriter
+	cacheControl string
+	wroteHeader  bool
+}
+
+func (w *staticCacheWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if code < 400 {
+			w.Header().Set("Cache-Control", w.cacheControl)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *staticCacheWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *staticCacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Serves files from dir for requests starting with prefix, instead of proxying them.
+// Runs as a regular middleware, so everything before it in the chain, like auth, applies.
+// Files are opened through os.Root, so neither `..` nor symlinks can escape dir.
+func StaticFiles(dir, prefix string, maxAge time.Duration) Middleware {
+	if dir == "" {
+		return nil
+	}
+	if prefix == "" || !strings.HasSuffix(prefix, "/") {
+		log.Fatal("Static prefix should end with '/' ", prefix)
+	}
+
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		log.Fatal("Can't open static folder ", err)
+	}
+
+	fileServer := http.StripPrefix(strings.TrimSuffix(prefix, "/"), http.FileServer(staticFS{http.FS(root.FS())}))
+	cacheControl := "public, max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.HasPrefix(r.URL.Path, prefix) {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			if !allowMethods(w, r, http.MethodGet) {
+				return
+			}
+
+			fileServer.ServeHTTP(&staticCacheWriter{ResponseWriter: w, cacheControl: cacheControl}, r)
+		})
+	}
+}
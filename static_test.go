@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStaticFiles(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+	modified := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	files := map[string]string{
+		"robots.txt":        "0123456789",
+		".env":              "SECRET=1",
+		"assets/app.css":    "body{}",
+		"site/index.html":   "<html></html>",
+		"../outside/secret": "secret",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if name == "../outside/secret" {
+			path = filepath.Join(outside, "secret")
+		}
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, modified, modified)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", "1")
+	})
+	h := Chain(upstream, StaticFiles(dir, "/static/", time.Hour))
+
+	tests := []struct {
+		name   string
+		path   string
+		header map[string]string
+		status int
+		body   string
+		check  map[string]string
+	}{
+		{"file", "/static/robots.txt", nil, http.StatusOK, "0123456789",
+			map[string]string{"Cache-Control": "public, max-age=3600", "Last-Modified": "Fri, 02 Jan 2026 03:04:05 GMT", "Accept-Ranges": "bytes"}},
+		{"range", "/static/robots.txt", map[string]string{"Range": "bytes=2-5"}, http.StatusPartialContent, "2345",
+			map[string]string{"Content-Range": "bytes 2-5/10", "Content-Length": "4"}},
+		{"suffix range", "/static/robots.txt", map[string]string{"Range": "bytes=-3"}, http.StatusPartialContent, "789",
+			map[string]string{"Content-Range": "bytes 7-9/10"}},
+		{"unsatisfiable range", "/static/robots.txt", map[string]string{"Range": "bytes=20-30"}, http.StatusRequestedRangeNotSatisfiable, "",
+			map[string]string{"Content-Range": "bytes */10"}},
+		{"not modified since", "/static/robots.txt", map[string]string{"If-Modified-Since": "Fri, 02 Jan 2026 03:04:05 GMT"}, http.StatusNotModified, "", nil},
+		{"modified since", "/static/robots.txt", map[string]string{"If-Modified-Since": "Thu, 01 Jan 2026 00:00:00 GMT"}, http.StatusOK, "0123456789", nil},
+		{"range if unchanged", "/static/robots.txt", map[string]string{"Range": "bytes=0-1", "If-Range": "Fri, 02 Jan 2026 03:04:05 GMT"}, http.StatusPartialContent, "01", nil},
+		{"range if changed", "/static/robots.txt", map[string]string{"Range": "bytes=0-1", "If-Range": "Thu, 01 Jan 2026 00:00:00 GMT"}, http.StatusOK, "0123456789", nil},
+		{"nested file", "/static/assets/app.css", nil, http.StatusOK, "body{}", nil},
+		{"directory index", "/static/site/", nil, http.StatusOK, "<html></html>", nil},
+		{"no listing", "/static/assets/", nil, http.StatusNotFound, "", nil},
+		{"dot file", "/static/.env", nil, http.StatusNotFound, "", nil},
+		{"traversal", "/static/../outside/secret", nil, http.StatusNotFound, "", nil},
+		{"symlink out of folder", "/static/link", nil, http.StatusNotFound, "", nil},
+		{"missing is not cached", "/static/missing.txt", nil, http.StatusNotFound, "", map[string]string{"Cache-Control": ""}},
+		{"other paths proxied", "/api", nil, http.StatusOK, "", map[string]string{"X-Upstream": "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", tt.path, nil)
+			// Sent as is, like by a raw client, instead of cleaned by httptest
+			r.URL.Path = tt.path
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.body)
+			}
+			for name, value := range tt.check {
+				if got := w.Header().Get(name); got != value {
+					t.Errorf("%s = %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
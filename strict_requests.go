@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Requests rejected as smuggling-prone, by reason
+var securityRejectedRequests = expvar.NewMap("security_rejected_requests")
+
+// Longer head lines are left to net/http, which rejects them
+const maxHeadLineSize = 1 << 20
+
+const (
+	scanHead = iota
+	scanBody
+	scanChunkSize
+	scanChunkData
+	scanChunkEnd
+	scanTrailer
+	scanStopped
+)
+
+// Follows raw HTTP/1 request stream of a connection, as net/http reads it, and checks
+// every request head before net/http normalizes it. Net/http silently drops Content-Length
+// sent with Transfer-Encoding, merges duplicate Content-Length and unfolds obsolete line
+// folding, so these constructs are invisible to handlers. Bytes are never changed.
+type headScanner struct {
+	mu       sync.Mutex
+	state    int
+	line     []byte
+	head     [][]byte
+	body     int64
+	verdicts []string
+}
+
+// Returns reason to reject the head, empty if head is fine, length of body
+// to skip and scanner state to continue with
+func checkHead(head [][]byte) (string, int64, int) {
+	if len(head) == 0 {
+		return "", 0, scanStopped
+	}
+	requestLine := string(head[0])
+	method, _, _ := strings.Cut(requestLine, " ")
+	http10 := strings.HasSuffix(requestLine, " HTTP/1.0")
+
+	var reason string
+	var contentLengths, transferEncodings []string
+	upgrade := false
+	for _, line := range head[1:] {
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') {
+			reason = "obsolete line folding"
+			continue
+		}
+		name, value, found := bytes.Cut(line, []byte(":"))
+		if !found || len(name) == 0 || bytes.ContainsAny(name, " \t") {
+			reason = "malformed header name"
+			continue
+		}
+		value = bytes.TrimSpace(value)
+		switch strings.ToLower(string(name)) {
+		case "content-length":
+			contentLengths = append(contentLengths, string(value))
+		case "transfer-encoding":
+			transferEncodings = append(transferEncodings, string(value))
+		case "upgrade":
+			upgrade = true
+		}
+	}
+
+	switch {
+	case reason != "":
+	case len(contentLengths) > 1:
+		reason = "duplicate Content-Length"
+	case len(transferEncodings) > 0 && len(contentLengths) > 0:
+		reason = "Transfer-Encoding with Content-Length"
+	case len(transferEncodings) > 0 && http10:
+		reason = "Transfer-Encoding in HTTP/1.0 request"
+	case len(transferEncodings) > 1:
+		reason = "duplicate Transfer-Encoding"
+	}
+
+	// Connection is closed after rejection, and tunnels are not HTTP anymore
+	if reason != "" || method == http.MethodConnect || upgrade {
+		return reason, 0, scanStopped
+	}
+	if len(transferEncodings) > 0 {
+		if !strings.EqualFold(strings.TrimSpace(transferEncodings[0]), "chunked") {
+			// Rejected by net/http as unsupported
+			return "", 0, scanStopped
+		}
+		return "", 0, scanChunkSize
+	}
+	if len(contentLengths) > 0 {
+		n, err := strconv.ParseInt(contentLengths[0], 10, 64)
+		if err != nil || n < 0 {
+			return "invalid Content-Length", 0, scanStopped
+		}
+		return "", n, scanBody
+	}
+	return "", 0, scanHead
+}
+
+func (s *headScanner) feed(p []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(p) > 0 && s.state != scanStopped {
+		if s.state == scanBody || s.state == scanChunkData {
+			n := int64(len(p))
+			if n > s.body {
+				n = s.body
+			}
+			p, s.body = p[n:], s.body-n
+			if s.body == 0 {
+				if s.state == scanBody {
+					s.state = scanHead
+				} else {
+					s.state = scanChunkEnd
+				}
+			}
+			continue
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			s.line = append(s.line, p...)
+			if len(s.line) > maxHeadLineSize {
+				s.state = scanStopped
+			}
+			return
+		}
+		s.line = append(s.line, p[:i]...)
+		p = p[i+1:]
+		line := bytes.TrimSuffix(s.line, []byte("\r"))
+		s.line = s.line[:0]
+
+		switch s.state {
+		case scanHead:
+			// Empty lines before request line are allowed
+			if len(line) == 0 && len(s.head) == 0 {
+				continue
+			}
+			if len(line) > 0 {
+				s.head = append(s.head, append([]byte(nil), line...))
+				continue
+			}
+			var verdict string
+			verdict, s.body, s.state = checkHead(s.head)
+			s.verdicts = append(s.verdicts, verdict)
+			s.head = s.head[:0]
+			if s.state == scanBody && s.body == 0 {
+				s.state = scanHead
+			}
+		case scanChunkSize:
+			size, _, _ := bytes.Cut(line, []byte(";"))
+			n, err := strconv.ParseInt(string(bytes.TrimSpace(size)), 16, 64)
+			switch {
+			case err != nil || n < 0:
+				s.state = scanStopped
+			case n == 0:
+				s.state = scanTrailer
+			default:
+				s.body, s.state = n, scanChunkData
+			}
+		case scanChunkEnd:
+			s.state = scanChunkSize
+		case scanTrailer:
+			if len(line) == 0 {
+				s.state = scanHead
+			}
+		}
+	}
+}
+
+// Returns verdict of the next request head, in the order net/http serves them
+func (s *headScanner) next() (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.verdicts) == 0 {
+		return "", false
+	}
+	verdict := s.verdicts[0]
+	s.verdicts = s.verdicts[1:]
+	return verdict, true
+}
+
+type scanningConn struct {
+	net.Conn
+	scanner *headScanner
+}
+
+func (c scanningConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.scanner.feed(p[:n])
+	return n, err
+}
+
+type scanningListener struct {
+	net.Listener
+}
+
+func (l scanningListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return scanningConn{conn, &headScanner{}}, nil
+}
+
+type headScannerContextKey struct{}
+
+// Wraps listeners, so StrictRequests can see raw request heads. Should wrap
+// plain text connections, i.e. be applied inside TLS.
+// Verdicts are matched to requests in order, so every request should reach the handler.
+// Net/http answers `OPTIONS *` itself, so it is passed to the handler instead.
+func ScanRequestHeads(listeners []net.Listener, server *http.Server) {
+	server.DisableGeneralOptionsHandler = true
+	for i := range listeners {
+		listeners[i] = scanningListener{listeners[i]}
+	}
+
+	connContext := server.ConnContext
+	server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+		if connContext != nil {
+			ctx = connContext(ctx, c)
+		}
+		if conn, ok := c.(scanningConn); ok {
+			ctx = context.WithValue(ctx, headScannerContextKey{}, conn.scanner)
+		}
+		return ctx
+	}
+}
+
+// Rejects smuggling-prone requests with 400, before any other middleware runs:
+// duplicate Content-Length, Transfer-Encoding with Content-Length or in HTTP/1.0 request,
+// duplicate Transfer-Encoding, obsolete line folding and whitespace in header names.
+// Other malformed heads are rejected by net/http itself. Requests to paths starting with
+// one of exclude prefixes are not rejected. Should wrap the whole handler.
+func StrictRequests(enabled bool, exclude string) Middleware {
+	if !enabled {
+		return nil
+	}
+	excluded := splitList(exclude)
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scanner, ok := r.Context().Value(headScannerContextKey{}).(*headScanner)
+			if !ok || r.ProtoMajor != 1 {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			// Verdict is taken for every request, to keep the rest matched to their requests
+			verdict, _ := scanner.next()
+			if verdict != "" {
+				// Scanner stops at rejected head, so connection is not reused unchecked
+				w.Header().Set("Connection", "close")
+				if len(excluded) == 0 || !hasAnyPrefix(r.URL.Path, excluded) {
+					securityRejectedRequests.Add(verdict, 1)
+					http.Error(w, "Bad Request: "+verdict, http.StatusBadRequest)
+					return
+				}
+			}
+
+			// What net/http general OPTIONS handler does
+			if r.Method == http.MethodOptions && r.RequestURI == "*" {
+				w.Header().Set("Content-Length", "0")
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func headLines(head string) [][]byte {
+	var lines [][]byte
+	for _, line := range strings.Split(head, "\r\n") {
+		lines = append(lines, []byte(line))
+	}
+	return lines
+}
+
+func TestCheckHead(t *testing.T) {
+	tests := []struct {
+		name   string
+		head   string
+		reason string
+		body   int64
+		state  int
+	}{
+		{"plain GET", "GET / HTTP/1.1\r\nHost: a", "", 0, scanHead},
+		{"content length", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5", "", 5, scanBody},
+		{"leading zeros", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 005", "", 5, scanBody},
+		{"chunked", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked", "", 0, scanChunkSize},
+		{"TE with CL", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nTransfer-Encoding: chunked", "Transfer-Encoding with Content-Length", 0, scanStopped},
+		{"CL with TE, case folded", "POST / HTTP/1.1\r\nhost: a\r\ntransfer-encoding: chunked\r\ncontent-length: 5", "Transfer-Encoding with Content-Length", 0, scanStopped},
+		{"duplicate CL", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nContent-Length: 5", "duplicate Content-Length", 0, scanStopped},
+		{"duplicate TE", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nTransfer-Encoding: chunked", "duplicate Transfer-Encoding", 0, scanStopped},
+		{"TE in HTTP/1.0", "POST / HTTP/1.0\r\nTransfer-Encoding: chunked", "Transfer-Encoding in HTTP/1.0 request", 0, scanStopped},
+		{"obs-fold", "GET / HTTP/1.1\r\nHost: a\r\nX-A: b\r\n continued", "obsolete line folding", 0, scanStopped},
+		{"obs-fold with tab", "GET / HTTP/1.1\r\nHost: a\r\nX-A: b\r\n\tcontinued", "obsolete line folding", 0, scanStopped},
+		{"space before colon", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding : chunked", "malformed header name", 0, scanStopped},
+		{"missing colon", "GET / HTTP/1.1\r\nHost a", "malformed header name", 0, scanStopped},
+		{"invalid CL", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3, 3", "invalid Content-Length", 0, scanStopped},
+		{"negative CL", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -1", "invalid Content-Length", 0, scanStopped},
+		{"unsupported TE", "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip", "", 0, scanStopped},
+		{"CONNECT", "CONNECT a:443 HTTP/1.1\r\nHost: a:443", "", 0, scanStopped},
+		{"upgrade", "GET / HTTP/1.1\r\nHost: a\r\nConnection: Upgrade\r\nUpgrade: websocket", "", 0, scanStopped},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, body, state := checkHead(headLines(tt.head))
+			if reason != tt.reason || body != tt.body || state != tt.state {
+				t.Errorf("checkHead() = %q, %d, %d, want %q, %d, %d", reason, body, state, tt.reason, tt.body, tt.state)
+			}
+		})
+	}
+}
+
+func TestHeadScannerPipelined(t *testing.T) {
+	stream := "GET /1 HTTP/1.1\r\nHost: a\r\n\r\n" +
+		"POST /2 HTTP/1.1\r\nHost: a\r\nContent-Length: 30\r\n\r\nGET /fake HTTP/1.1\r\nHost: a\r\n\r\n" +
+		"POST /3 HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nX-Trailer: a\r\n\r\n" +
+		"POST /4 HTTP/1.1\r\nHost: a\r\nContent-Length: 1\r\nTransfer-Encoding: chunked\r\n\r\n"
+
+	s := &headScanner{}
+	s.feed([]byte(stream))
+	want := []string{"", "", "", "Transfer-Encoding with Content-Length"}
+	if !reflect.DeepEqual(s.verdicts, want) {
+		t.Errorf("verdicts = %q, want %q", s.verdicts, want)
+	}
+}
+
+func FuzzHeadScanner(f *testing.F) {
+	f.Add([]byte("GET / HTTP/1.1\r\nHost: a\r\n\r\n"), uint(5))
+	f.Add([]byte("POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n"), uint(17))
+	f.Add([]byte("POST / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n3;ext=1\r\nabc\r\n0\r\n\r\nGET / HTTP/1.1\r\nX: a\r\n b\r\n\r\n"), uint(40))
+	f.Add([]byte("GET / HTTP/1.0\nTransfer-Encoding: chunked\n\n"), uint(1))
+
+	f.Fuzz(func(t *testing.T, stream []byte, split uint) {
+		whole := &headScanner{}
+		whole.feed(stream)
+
+		// Verdicts do not depend on how stream is split into reads
+		parts := &headScanner{}
+		at := int(split % uint(len(stream)+1))
+		parts.feed(stream[:at])
+		parts.feed(stream[at:])
+		if !reflect.DeepEqual(whole.verdicts, parts.verdicts) || whole.state != parts.state {
+			t.Errorf("split at %d: verdicts %q state %d, whole stream: verdicts %q state %d",
+				at, parts.verdicts, parts.state, whole.verdicts, whole.state)
+		}
+	})
+}
+
+// Starts server with request heads scanning, as main does
+func newStrictServer(t *testing.T, h http.Handler) *httptest.Server {
+	server := httptest.NewUnstartedServer(Chain(h, StrictRequests(true, "/legacy/")))
+	listeners := []net.Listener{server.Listener}
+	ScanRequestHeads(listeners, server.Config)
+	server.Listener = listeners[0]
+	server.Start()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Sends raw pipelined requests, and returns statuses of responses
+func sendRaw(t *testing.T, addr string, raw string, methods ...string) []int {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+
+	var statuses []int
+	reader := bufio.NewReader(conn)
+	for _, method := range methods {
+		resp, err := http.ReadResponse(reader, &http.Request{Method: method})
+		if err != nil {
+			break
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		statuses = append(statuses, resp.StatusCode)
+	}
+	return statuses
+}
+
+func TestStrictRequests(t *testing.T) {
+	var served bytes.Buffer
+	server := newStrictServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		served.WriteString(r.URL.Path + " ")
+	}))
+	addr := server.Listener.Addr().String()
+	teCL := "POST /smuggle HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"
+
+	tests := []struct {
+		name     string
+		raw      string
+		methods  []string
+		statuses []int
+	}{
+		{"TE with CL", teCL, []string{"POST"}, []int{400}},
+		{"after clean request", "GET /ok HTTP/1.1\r\nHost: a\r\n\r\n" + teCL, []string{"GET", "POST"}, []int{200, 400}},
+		// Answered by net/http itself unless disabled, which would shift verdicts
+		{"after OPTIONS *", "OPTIONS * HTTP/1.1\r\nHost: a\r\n\r\n" + teCL, []string{"OPTIONS", "POST"}, []int{200, 400}},
+		{"duplicate CL", "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1\r\nContent-Length: 1\r\n\r\nx", []string{"POST"}, []int{400}},
+		{"obs-fold", "GET / HTTP/1.1\r\nHost: a\r\nX-A: b\r\n c\r\n\r\n", []string{"GET"}, []int{400}},
+		{"excluded path", "POST /legacy/a HTTP/1.1\r\nHost: a\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", []string{"POST"}, []int{200}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			statuses := sendRaw(t, addr, tt.raw, tt.methods...)
+			if !reflect.DeepEqual(statuses, tt.statuses) {
+				t.Errorf("statuses = %v, want %v", statuses, tt.statuses)
+			}
+		})
+	}
+	if strings.Contains(served.String(), "/smuggle") {
+		t.Errorf("smuggling request reached handler: %s", served.String())
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const syntheticScheme = "synthetic"
+
+var syntheticResponses = expvar.NewInt("synthetic_responses")
+
+// Endless stream of the same byte, so large bodies are not allocated
+type repeatReader byte
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+// Answers every request locally, after a random latency between minLatency and maxLatency
+type syntheticTransport struct {
+	status     int
+	size       int64
+	minLatency time.Duration
+	maxLatency time.Duration
+	// Pre-computed, as they are the same for every response
+	statusLine    string
+	contentLength string
+}
+
+// Parses `synthetic://<name>?status=200&size=1024&latency=10ms-50ms` target.
+// Latency is either fixed duration, or `<min>-<max>` range picked uniformly.
+func parseSyntheticTarget(target *url.URL) (*syntheticTransport, error) {
+	t := &syntheticTransport{status: http.StatusOK}
+	query := target.Query()
+
+	if status := query.Get("status"); status != "" {
+		code, err := strconv.Atoi(status)
+		if err != nil || code < 200 || code > 999 {
+			return nil, fmt.Errorf("Synthetic status should be a number from 200 to 999 '%s'", status)
+		}
+		t.status = code
+	}
+	if size := query.Get("size"); size != "" {
+		n, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Synthetic size should be a number of bytes '%s'", size)
+		}
+		t.size = n
+	}
+	if latency := query.Get("latency"); latency != "" {
+		min, max, found := strings.Cut(latency, "-")
+		if !found {
+			max = min
+		}
+		var err error
+		if t.minLatency, err = time.ParseDuration(min); err == nil {
+			t.maxLatency, err = time.ParseDuration(max)
+		}
+		if err != nil || t.minLatency < 0 || t.maxLatency < t.minLatency {
+			return nil, fmt.Errorf("Synthetic latency should be a duration, or '<min>-<max>' range '%s'", latency)
+		}
+	}
+	t.statusLine = strconv.Itoa(t.status) + " " + http.StatusText(t.status)
+	t.contentLength = strconv.FormatInt(t.size, 10)
+	return t, nil
+}
+
+func (t *syntheticTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Body != nil {
+		io.Copy(io.Discard, r.Body)
+		r.Body.Close()
+	}
+
+	latency := t.minLatency
+	if t.maxLatency > t.minLatency {
+		latency += time.Duration(rand.Int63n(int64(t.maxLatency - t.minLatency)))
+	}
+	if latency > 0 {
+		timer := time.NewTimer(latency)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+
+	syntheticResponses.Add(1)
+	// Keys are already canonical
+	header := http.Header{
+		"Content-Type":         {"application/octet-stream"},
+		"Content-Length":       {t.contentLength},
+		"X-Synthetic-Response": {"true"},
+	}
+	body := io.NopCloser(io.LimitReader(repeatReader('x'), t.size))
+	// Like real upstream, HEAD gets Content-Length without body
+	if r.Method == http.MethodHead {
+		body = http.NoBody
+	}
+	return &http.Response{
+		Status:        t.statusLine,
+		StatusCode:    t.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: t.size,
+		Request:       r,
+	}, nil
+}
+
+// Serves `synthetic://` target locally instead of proxying, to load test the proxy
+// and plugins without a real upstream. Responses go through the same proxy options
+// and middlewares as real ones, and are marked with `X-Synthetic-Response: true`.
+// Should be applied first, before options wrapping the transport.
+func SyntheticUpstream(target *url.URL) ProxyOption {
+	if target.Scheme != syntheticScheme {
+		return nil
+	}
+	transport, err := parseSyntheticTarget(target)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return func(proxy *httputil.ReverseProxy) {
+		log.Println("Serving synthetic responses instead of proxying, do not use in production")
+		proxy.Transport = transport
+	}
+}
@@ -0,0 +1,72 @@
+// Package trail defines the ordered list of decisions middlewares make about a request,
+// e.g. why auth rejected it. Built-in middlewares append to it, and plugins import it
+// to read what happened earlier in the chain.
+package trail
+
+import (
+	"context"
+	"sync"
+)
+
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// Decision made by a middleware about a request
+type Entry struct {
+	Middleware string
+	Decision   string
+	Detail     string
+}
+
+// Rendered the same way in debug headers and access log
+func (e Entry) String() string {
+	return e.Middleware + " " + e.Decision + ": " + e.Detail
+}
+
+// Append-only, entries can't be changed once added. Nil trail ignores appends,
+// so middlewares do not need to check whether trail exists.
+type Trail struct {
+	mu      sync.Mutex
+	entries []Entry
+}
+
+func (t *Trail) Append(e Entry) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries = append(t.entries, e)
+}
+
+// Copy of entries in the order they were added
+func (t *Trail) Entries() []Entry {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Entry(nil), t.entries...)
+}
+
+type contextKey struct{}
+
+// Reports whether key is the key of trail in request context, for contexts carrying
+// several values in one layer, like the proxy's own request state. Value under the key should be *Trail.
+func IsContextKey(key interface{}) bool {
+	_, ok := key.(contextKey)
+	return ok
+}
+
+func NewContext(ctx context.Context) (context.Context, *Trail) {
+	t := &Trail{}
+	return context.WithValue(ctx, contextKey{}, t), t
+}
+
+// Returns nil if request has no trail
+func FromContext(ctx context.Context) *Trail {
+	t, _ := ctx.Value(contextKey{}).(*Trail)
+	return t
+}
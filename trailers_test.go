@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Announces X-Checksum trailer up front, and sends X-Late one without announcing it
+func trailerUpstream(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Trailer", "X-Checksum")
+	io.WriteString(w, `{"ssn":"123456789"}`)
+	w.(http.Flusher).Flush()
+	w.Header().Set("X-Checksum", "abc")
+	w.Header().Set(http.TrailerPrefix+"X-Late", "late")
+}
+
+// Stands for a plugin adding its own trailer once the body is written
+func addTrailer(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r)
+		w.Header().Set(http.TrailerPrefix+"X-Plugin", "added")
+	})
+}
+
+func TestTrailers(t *testing.T) {
+	tests := []struct {
+		name    string
+		http2   bool
+		options []ProxyOption
+		// Trailers expected by the client
+		want map[string]string
+	}{
+		{"http1", false, nil, map[string]string{"X-Checksum": "abc", "X-Late": "late", "X-Plugin": "added"}},
+		{"http2", true, nil, map[string]string{"X-Checksum": "abc", "X-Late": "late", "X-Plugin": "added"}},
+		{"http1 redacted", false, []ProxyOption{JSONRedaction("/ssn=mask", nil, "", 1<<20, false)}, map[string]string{"X-Checksum": "abc", "X-Late": "late", "X-Plugin": "added"}},
+		{"http2 redacted", true, []ProxyOption{JSONRedaction("/ssn=mask", nil, "", 1<<20, false)}, map[string]string{"X-Checksum": "abc", "X-Late": "late", "X-Plugin": "added"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewUnstartedServer(http.HandlerFunc(trailerUpstream))
+			upstream.EnableHTTP2 = tt.http2
+			upstream.StartTLS()
+			defer upstream.Close()
+
+			target, _ := url.Parse(upstream.URL)
+			options := append([]ProxyOption{func(proxy *httputil.ReverseProxy) {
+				proxy.Transport = upstream.Client().Transport
+				proxy.ErrorLog = log.New(io.Discard, "", 0)
+			}}, tt.options...)
+			h := Chain(ApplyProxyOptions(Proxy(target, ""), options...), DecisionTrail(), ProtocolLabels(), addTrailer, AccessLogCapture())
+
+			front := httptest.NewUnstartedServer(h)
+			front.EnableHTTP2 = tt.http2
+			front.StartTLS()
+			defer front.Close()
+
+			resp, err := front.Client().Get(front.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if tt.http2 && resp.ProtoMajor != 2 {
+				t.Fatalf("protocol %s, want HTTP/2", resp.Proto)
+			}
+			body, _ := io.ReadAll(resp.Body)
+
+			if len(tt.options) > 0 && strings.Contains(string(body), "123456789") {
+				t.Errorf("body is not redacted %q", body)
+			}
+			// Announced trailers are listed before the body
+			if _, found := resp.Trailer["X-Checksum"]; !found {
+				t.Errorf("X-Checksum is not announced, trailer %v", resp.Trailer)
+			}
+			if !tt.http2 && len(resp.TransferEncoding) == 0 {
+				t.Errorf("HTTP/1.1 response with trailers should be chunked, body %q", body)
+			}
+			for name, value := range tt.want {
+				if got := resp.Trailer.Get(name); got != value {
+					t.Errorf("trailer %s = %q, want %q", name, got, value)
+				}
+			}
+		})
+	}
+}
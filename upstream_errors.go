@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"net/http/httputil"
+
+	"github.com/TykTechnologies/go-plugins-template/upstreamerr"
+)
+
+// Upstream failures by upstreamerr code
+var upstreamErrors = expvar.NewMap("upstream_errors")
+
+// Replaces generic 502 of the proxy with status and JSON body based on failure
+// classification, e.g. 504 with `{"error":"Gateway Timeout","reason":"timeout"}`.
+// Error handler set by a patch is kept.
+func UpstreamErrors() ProxyOption {
+	return func(proxy *httputil.ReverseProxy) {
+		if proxy.ErrorHandler != nil {
+			log.Println("Proxy already has ErrorHandler, upstream errors are not classified")
+			return
+		}
+
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			code := upstreamerr.Classify(err)
+			status := code.Status()
+			upstreamErrors.Add(string(code), 1)
+			log.Printf("Upstream error reason=%s status=%d method=%s path=%s: %v", code, status, r.Method, r.URL.Path, err)
+
+			// Nobody reads the response, but access log still records the status
+			if code == upstreamerr.ClientCanceled {
+				w.WriteHeader(status)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error":  http.StatusText(status),
+				"reason": string(code),
+			})
+		}
+	}
+}
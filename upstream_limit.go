@@ -0,0 +1,130 @@
+package main
+
+import (
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/TykTechnologies/go-plugins-template/upstreamerr"
+)
+
+var (
+	upstreamInFlight      = expvar.NewInt("upstream_in_flight")
+	upstreamQueued        = expvar.NewInt("upstream_queued")
+	upstreamQueueTimeouts = expvar.NewInt("upstream_queue_timeouts")
+	upstreamQueueRejected = expvar.NewInt("upstream_queue_rejected")
+	upstreamQueueWait     = newHistogram("upstream_queue_wait",
+		time.Millisecond, 10*time.Millisecond, 100*time.Millisecond, time.Second, 5*time.Second)
+)
+
+var (
+	errUpstreamQueueFull    = upstreamerr.ErrQueueFull
+	errUpstreamQueueTimeout = upstreamerr.ErrQueueTimeout
+)
+
+// Bounds number of concurrent upstream requests. Slot is taken once per round trip,
+// and held until response body is closed, so upstream sees bounded parallelism
+// while the rest of the chain runs without waiting.
+type concurrencyLimitedTransport struct {
+	next    http.RoundTripper
+	slots   chan struct{}
+	queued  int64
+	depth   int64
+	timeout time.Duration
+}
+
+func (t *concurrencyLimitedTransport) acquire(r *http.Request) error {
+	select {
+	case t.slots <- struct{}{}:
+		upstreamQueueWait.Observe(0)
+		return nil
+	default:
+	}
+
+	if atomic.AddInt64(&t.queued, 1) > t.depth {
+		atomic.AddInt64(&t.queued, -1)
+		upstreamQueueRejected.Add(1)
+		return errUpstreamQueueFull
+	}
+	upstreamQueued.Add(1)
+	defer func() {
+		atomic.AddInt64(&t.queued, -1)
+		upstreamQueued.Add(-1)
+	}()
+
+	start := time.Now()
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+
+	select {
+	case t.slots <- struct{}{}:
+		upstreamQueueWait.Observe(time.Since(start))
+		return nil
+	case <-timer.C:
+		upstreamQueueTimeouts.Add(1)
+		return errUpstreamQueueTimeout
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
+
+func (t *concurrencyLimitedTransport) release() {
+	<-t.slots
+	upstreamInFlight.Add(-1)
+}
+
+func (t *concurrencyLimitedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if err := t.acquire(r); err != nil {
+		return nil, err
+	}
+	upstreamInFlight.Add(1)
+
+	resp, err := t.next.RoundTrip(r)
+	// Upgraded connections are not regular requests anymore, and their
+	// body must stay io.ReadWriteCloser, so slot is released right away
+	if err != nil || resp.StatusCode == http.StatusSwitchingProtocols {
+		t.release()
+		return resp, err
+	}
+
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: t.release}
+	return resp, nil
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// Limits concurrent upstream requests to max. Excess requests wait in a queue,
+// up to depth requests for at most timeout, and fail otherwise.
+func UpstreamConcurrencyLimit(max int, depth int, timeout time.Duration) ProxyOption {
+	if max <= 0 {
+		return nil
+	}
+
+	return func(proxy *httputil.ReverseProxy) {
+		next := proxy.Transport
+		if next == nil {
+			next = http.DefaultTransport
+		}
+
+		proxy.Transport = &concurrencyLimitedTransport{
+			next:    next,
+			slots:   make(chan struct{}, max),
+			depth:   int64(depth),
+			timeout: timeout,
+		}
+	}
+}
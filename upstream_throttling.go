@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+
+	"github.com/TykTechnologies/go-plugins-template/upstreamerr"
+)
+
+const (
+	ThrottlePassthrough = "passthrough"
+	ThrottleTranslate   = "translate"
+)
+
+// Upstream throttling responses by status, separate from upstream_errors,
+// since upstream answered and asked to back off
+var upstreamThrottled = expvar.NewMap("upstream_throttled")
+
+// Upstream body is read to the end before it is replaced, so its trailers arrive right away
+// instead of while the new body is sent. Larger bodies are passed untouched.
+const maxThrottleBodySize = 64 << 10
+
+// Counts upstream responses with given comma separated statuses, e.g. `429,503`, as throttling.
+// With translate policy, their body is replaced with the proxy's own error format,
+// `{"error":"Too Many Requests","reason":"upstream_throttled"}`, keeping status and Retry-After.
+// Passthrough policy sends upstream response untouched.
+func UpstreamThrottling(policy, statuses string) ProxyOption {
+	if policy != ThrottlePassthrough && policy != ThrottleTranslate {
+		log.Fatal("Upstream throttle policy should be 'passthrough' or 'translate' ", policy)
+	}
+	throttling := make(map[int]bool)
+	for _, item := range splitList(statuses) {
+		status, err := strconv.Atoi(item)
+		if err != nil || status < 400 || status > 599 {
+			log.Fatal("Upstream throttle status should be 4xx or 5xx ", item)
+		}
+		throttling[status] = true
+	}
+	if len(throttling) == 0 {
+		return nil
+	}
+
+	return func(proxy *httputil.ReverseProxy) {
+		appendModifyResponse(proxy, func(resp *http.Response) error {
+			if !throttling[resp.StatusCode] {
+				return nil
+			}
+			upstreamThrottled.Add(strconv.Itoa(resp.StatusCode), 1)
+			if policy == ThrottlePassthrough {
+				return nil
+			}
+
+			consumed, err := io.ReadAll(io.LimitReader(resp.Body, maxThrottleBodySize+1))
+			if err != nil {
+				return err
+			}
+			if len(consumed) > maxThrottleBodySize {
+				resp.Body = readCloser{io.MultiReader(bytes.NewReader(consumed), resp.Body), resp.Body}
+				return nil
+			}
+
+			body, _ := json.Marshal(map[string]string{
+				"error":  http.StatusText(resp.StatusCode),
+				"reason": string(upstreamerr.Throttled),
+			})
+			body = append(body, '\n')
+
+			resp.Body.Close()
+			resp.Body = readCloser{bytes.NewReader(body), resp.Body}
+			resp.ContentLength = int64(len(body))
+			resp.Header = http.Header{
+				"Content-Type":   {"application/json"},
+				"Content-Length": {strconv.Itoa(len(body))},
+				"Retry-After":    resp.Header.Values("Retry-After"),
+			}
+			if len(resp.Header["Retry-After"]) == 0 {
+				delete(resp.Header, "Retry-After")
+			}
+			resp.Trailer = nil
+			return nil
+		})
+	}
+}
+
+// Reads from already consumed part of body, while closing the original one
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"expvar"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Value of a counter in expvar map, 0 if it was not added yet
+func expvarInt(v expvar.Var) int64 {
+	if i, ok := v.(*expvar.Int); ok {
+		return i.Value()
+	}
+	return 0
+}
+
+func TestUpstreamThrottling(t *testing.T) {
+	const translated = `{"error":"Too Many Requests","reason":"upstream_throttled"}` + "\n"
+	tests := []struct {
+		name     string
+		policy   string
+		statuses string
+		status   int
+		body     string
+		want     string
+	}{
+		{"429 translated", ThrottleTranslate, "429", http.StatusTooManyRequests, "slow down", translated},
+		{"503 passes by default", ThrottleTranslate, "429", http.StatusServiceUnavailable, "down", "down"},
+		{"503 translated when listed", ThrottleTranslate, "429,503", http.StatusServiceUnavailable, "down", `{"error":"Service Unavailable","reason":"upstream_throttled"}` + "\n"},
+		{"passthrough", ThrottlePassthrough, "429", http.StatusTooManyRequests, "slow down", "slow down"},
+		{"large body passes", ThrottleTranslate, "429", http.StatusTooManyRequests, strings.Repeat("a", maxThrottleBodySize+1), strings.Repeat("a", maxThrottleBodySize+1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Retry-After", "5")
+				w.Header().Set("Trailer", "X-Checksum")
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+				w.Header().Set("X-Checksum", "abc")
+			}))
+			defer upstream.Close()
+
+			target, _ := url.Parse(upstream.URL)
+			h := ApplyProxyOptions(Proxy(target, ""), func(proxy *httputil.ReverseProxy) {
+				proxy.ErrorLog = log.New(io.Discard, "", 0)
+			}, UpstreamThrottling(tt.policy, tt.statuses))
+			before := expvarInt(upstreamThrottled.Get(strconv.Itoa(tt.status)))
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if w.Body.String() != tt.want {
+				t.Errorf("body %.100q, want %.100q", w.Body.String(), tt.want)
+			}
+			if w.Header().Get("Retry-After") != "5" {
+				t.Errorf("Retry-After %q", w.Header().Get("Retry-After"))
+			}
+			// Upstream trailers do not belong to the replaced body
+			if checksum := w.Result().Trailer.Get("X-Checksum"); (checksum != "") != (tt.body == tt.want) {
+				t.Errorf("trailer X-Checksum %q", checksum)
+			}
+
+			counted := expvarInt(upstreamThrottled.Get(strconv.Itoa(tt.status))) - before
+			if want := int64(strings.Count(tt.statuses, strconv.Itoa(tt.status))); counted != want {
+				t.Errorf("counted %d, want %d", counted, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+// Package upstreamerr classifies upstream failures. The proxy uses it to pick
+// response status and reason code, and plugins import it to see the same taxonomy.
+package upstreamerr
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+type Code string
+
+const (
+	DNSFailure        Code = "dns_failure"
+	ConnectionRefused Code = "connection_refused"
+	TLSHandshake      Code = "tls_handshake_failure"
+	Timeout           Code = "timeout"
+	BodyRead          Code = "body_read_error"
+	ClientCanceled    Code = "client_canceled"
+	QueueFull         Code = "queue_full"
+	QueueTimeout      Code = "queue_timeout"
+	ResponseTooLarge  Code = "response_too_large"
+	// Upstream answered with 429 or 503, never returned by Classify
+	Throttled Code = "upstream_throttled"
+	Unknown   Code = "upstream_error"
+)
+
+// Non-standard status, used by nginx too, for requests client gave up on
+const StatusClientClosedRequest = 499
+
+// Returned by the proxy itself, before or instead of reaching upstream
+var (
+	ErrQueueFull        = errors.New("upstream concurrency queue is full")
+	ErrQueueTimeout     = errors.New("timeout waiting in upstream concurrency queue")
+	ErrResponseTooLarge = errors.New("upstream response exceeds max response size")
+)
+
+// Maps error returned by transport or response modifiers to failure code.
+// Proxy errors are checked first, as context errors may wrap them.
+func Classify(err error) Code {
+	var dnsErr *net.DNSError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var verifyErr *tls.CertificateVerificationError
+	var hostnameErr x509.HostnameError
+	var authorityErr x509.UnknownAuthorityError
+	var invalidErr x509.CertificateInvalidError
+	var netErr net.Error
+
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrQueueFull):
+		return QueueFull
+	case errors.Is(err, ErrQueueTimeout):
+		return QueueTimeout
+	case errors.Is(err, ErrResponseTooLarge):
+		return ResponseTooLarge
+	case errors.Is(err, context.Canceled):
+		return ClientCanceled
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return Timeout
+		}
+		return DNSFailure
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ConnectionRefused
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &verifyErr),
+		errors.As(err, &hostnameErr), errors.As(err, &authorityErr), errors.As(err, &invalidErr):
+		return TLSHandshake
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return Timeout
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return BodyRead
+	}
+	return Unknown
+}
+
+// Response status for the failure: 504 for timeouts, 503 when proxy sheds load,
+// 499 when client is gone, and 502 otherwise
+func (c Code) Status() int {
+	switch c {
+	case Timeout, QueueTimeout:
+		return http.StatusGatewayTimeout
+	case QueueFull:
+		return http.StatusServiceUnavailable
+	case ClientCanceled:
+		return StatusClientClosedRequest
+	}
+	return http.StatusBadGateway
+}
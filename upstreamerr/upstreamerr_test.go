@@ -0,0 +1,65 @@
+package upstreamerr
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Wraps err the way http.Transport and ReverseProxy return it
+func transportError(err error) error {
+	return &url.Error{Op: "Get", URL: "http://upstream/", Err: err}
+}
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		code   Code
+		status int
+	}{
+		{"nil", nil, "", 0},
+		{"DNS failure", transportError(&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "upstream", IsNotFound: true}}), DNSFailure, http.StatusBadGateway},
+		{"DNS timeout", &net.DNSError{Err: "timeout", Name: "upstream", IsTimeout: true}, Timeout, http.StatusGatewayTimeout},
+		{"connection refused", transportError(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}), ConnectionRefused, http.StatusBadGateway},
+		{"dial timeout", transportError(&net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}), Timeout, http.StatusGatewayTimeout},
+		{"unknown authority", transportError(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}), TLSHandshake, http.StatusBadGateway},
+		{"bare unknown authority", fmt.Errorf("handshake: %w", x509.UnknownAuthorityError{}), TLSHandshake, http.StatusBadGateway},
+		{"hostname mismatch", transportError(x509.HostnameError{Host: "upstream", Certificate: &x509.Certificate{}}), TLSHandshake, http.StatusBadGateway},
+		{"TLS alert", transportError(&net.OpError{Op: "remote error", Err: tls.AlertError(40)}), TLSHandshake, http.StatusBadGateway},
+		{"plain HTTP to TLS port", transportError(tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}), TLSHandshake, http.StatusBadGateway},
+		{"deadline exceeded", transportError(context.DeadlineExceeded), Timeout, http.StatusGatewayTimeout},
+		{"client canceled", transportError(context.Canceled), ClientCanceled, StatusClientClosedRequest},
+		{"body read", fmt.Errorf("reading body: %w", io.ErrUnexpectedEOF), BodyRead, http.StatusBadGateway},
+		{"queue full", ErrQueueFull, QueueFull, http.StatusServiceUnavailable},
+		{"queue timeout wrapped in deadline", fmt.Errorf("%w: %w", ErrQueueTimeout, context.DeadlineExceeded), QueueTimeout, http.StatusGatewayTimeout},
+		{"response too large", fmt.Errorf("copy: %w", ErrResponseTooLarge), ResponseTooLarge, http.StatusBadGateway},
+		{"unknown", errors.New("something else"), Unknown, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := Classify(tt.err)
+			if code != tt.code {
+				t.Errorf("Classify() = %q, want %q", code, tt.code)
+			}
+			if tt.err != nil && code.Status() != tt.status {
+				t.Errorf("Status() = %d, want %d", code.Status(), tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const anonymousIdentity = "anonymous"
+
+// Bytes actually read from and written to clients, by identity
+var (
+	bytesIn  = expvar.NewMap("bytes_in")
+	bytesOut = expvar.NewMap("bytes_out")
+)
+
+type usageContextKey struct{}
+
+// Per request usage, shared via context, so auth middlewares down the chain
+// can attribute it to identity
+type requestUsage struct {
+	identity string
+	in, out  int64
+}
+
+// Attributes request usage to identity, called by auth middlewares
+func setUsageIdentity(r *http.Request, identity string) {
+	if usage, ok := r.Context().Value(usageContextKey{}).(*requestUsage); ok {
+		usage.identity = identity
+	}
+}
+
+type countingBody struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (b countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.n, int64(n))
+	return n, err
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n *int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+func (w countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Usage collected since last periodic report
+type usageSummary struct {
+	sync.Mutex
+	identities map[string]*[2]int64
+}
+
+func (s *usageSummary) add(usage *requestUsage) {
+	s.Lock()
+	defer s.Unlock()
+	totals, ok := s.identities[usage.identity]
+	if !ok {
+		totals = new([2]int64)
+		s.identities[usage.identity] = totals
+	}
+	totals[0] += usage.in
+	totals[1] += usage.out
+}
+
+func (s *usageSummary) report(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.Lock()
+		identities := s.identities
+		s.identities = make(map[string]*[2]int64)
+		s.Unlock()
+
+		if len(identities) == 0 {
+			continue
+		}
+		record := make(map[string]map[string]int64, len(identities))
+		for identity, totals := range identities {
+			record[identity] = map[string]int64{"bytes_in": totals[0], "bytes_out": totals[1]}
+		}
+		summary, _ := json.Marshal(map[string]interface{}{"usage": record, "interval": interval.String()})
+		log.Println(string(summary))
+	}
+}
+
+// Counts request body bytes read from client and response bytes written to it, per identity.
+// Aborted transfers are counted up to the point where they stopped.
+// Should be first in the chain, even before DecisionTrail, to see bytes exactly as they go
+// over the wire, including responses of middlewares rejecting requests.
+func UsageAccounting(enabled bool, reportInterval time.Duration) Middleware {
+	if !enabled {
+		return nil
+	}
+
+	var summary *usageSummary
+	if reportInterval > 0 {
+		summary = &usageSummary{identities: make(map[string]*[2]int64)}
+		go summary.report(reportInterval)
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			usage := &requestUsage{identity: anonymousIdentity}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = countingBody{r.Body, &usage.in}
+			}
+
+			defer func() {
+				in, out := atomic.LoadInt64(&usage.in), atomic.LoadInt64(&usage.out)
+				bytesIn.Add(usage.identity, in)
+				bytesOut.Add(usage.identity, out)
+				if summary != nil {
+					summary.add(&requestUsage{identity: usage.identity, in: in, out: out})
+				}
+			}()
+
+			ctx := context.WithValue(r.Context(), usageContextKey{}, usage)
+			h.ServeHTTP(countingWriter{w, &usage.out}, r.WithContext(ctx))
+		})
+	}
+}
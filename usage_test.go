@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Server counting usage of user authenticated by basic auth, done is closed once handler returned
+func newUsageServer(t *testing.T, user string, h http.HandlerFunc) (*httptest.Server, <-chan struct{}) {
+	done := make(chan struct{})
+	finished := func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer close(done)
+			h.ServeHTTP(w, r)
+		})
+	}
+	server := httptest.NewServer(Chain(h, finished, UsageAccounting(true, 0), BasicAuth(user, LoadSecret("basic-password", "pw"))))
+	t.Cleanup(server.Close)
+	return server, done
+}
+
+// Client stops sending its body half way
+func TestUsageAbortedUpload(t *testing.T) {
+	received := make(chan struct{})
+	server, done := newUsageServer(t, "usage-upload", func(w http.ResponseWriter, r *http.Request) {
+		io.ReadFull(r.Body, make([]byte, 500))
+		close(received)
+		io.Copy(io.Discard, r.Body)
+	})
+
+	body, upload := io.Pipe()
+	req, _ := http.NewRequest(http.MethodPost, server.URL, body)
+	req.SetBasicAuth("usage-upload", "pw")
+	go func() {
+		upload.Write(bytes.Repeat([]byte("a"), 500))
+		<-received
+		upload.CloseWithError(errors.New("client went away"))
+	}()
+	before := expvarInt(bytesIn.Get("usage-upload"))
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+	}
+	<-done
+
+	if in := expvarInt(bytesIn.Get("usage-upload")) - before; in != 500 {
+		t.Errorf("bytes_in = %d, want 500", in)
+	}
+}
+
+// Response stream is cut after the first chunk
+func TestUsageAbortedDownload(t *testing.T) {
+	server, done := newUsageServer(t, "usage-download", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write(bytes.Repeat([]byte("a"), 1000))
+		http.NewResponseController(w).Flush()
+		panic(http.ErrAbortHandler)
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewReader(bytes.Repeat([]byte("b"), 300)))
+	req.SetBasicAuth("usage-download", "pw")
+	in, out := expvarInt(bytesIn.Get("usage-download")), expvarInt(bytesOut.Get("usage-download"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil || len(got) != 1000 {
+		t.Errorf("read %d bytes, error %v, want stream cut after 1000", len(got), err)
+	}
+	<-done
+
+	if in := expvarInt(bytesIn.Get("usage-download")) - in; in != 300 {
+		t.Errorf("bytes_in = %d, want 300", in)
+	}
+	if out := expvarInt(bytesOut.Get("usage-download")) - out; out != 1000 {
+		t.Errorf("bytes_out = %d, want 1000", out)
+	}
+}
+
+// Requests rejected by auth are counted as anonymous
+func TestUsageRejected(t *testing.T) {
+	server, done := newUsageServer(t, "usage-rejected", func(w http.ResponseWriter, r *http.Request) {})
+	before := expvarInt(bytesOut.Get(anonymousIdentity))
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	<-done
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status %d", resp.StatusCode)
+	}
+	if out := expvarInt(bytesOut.Get(anonymousIdentity)) - before; out != int64(len(body)) {
+		t.Errorf("bytes_out = %d, want %d", out, len(body))
+	}
+}